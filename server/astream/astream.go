@@ -0,0 +1,227 @@
+// Package astream relays a live audio stream, like the mp3 that stream_audio
+// sends, to any number of HTTP listeners.
+package astream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/s4y/space/util"
+)
+
+const (
+	// New listeners get this much of the stream right away, so that
+	// playback can start before the next chunk arrives.
+	defaultBurstSize = 64 * 1024
+	// Listeners that fall this many chunks behind get disconnected.
+	listenerQueue = 64
+	chunkSize     = 4096
+)
+
+// A SourceEvent says that a source connected to or disconnected from a
+// stream.
+type SourceEvent struct {
+	Connected bool   `json:"connected"`
+	Addr      string `json:"addr"`
+	Listeners int    `json:"listeners"`
+}
+
+type Stream struct {
+	ContentType string
+	BurstSize   int
+	// OnSource, if set, gets the raw stream from each source as it plays,
+	// until the source disconnects. It never holds up listeners: if it
+	// falls listenerQueue chunks behind, it misses chunks.
+	OnSource func(io.Reader)
+
+	mutex     sync.Mutex
+	burst     []byte
+	listeners map[chan []byte]bool
+	source    net.Conn
+	observers util.Observers[SourceEvent]
+}
+
+// ObserveSource calls cb whenever a source connects or disconnects, and with
+// the current state first.
+func (s *Stream) ObserveSource(ctx context.Context, cb func(SourceEvent)) util.Subscription {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.observers.Add(ctx, cb, util.Options[SourceEvent]{
+		Initial: []SourceEvent{s.sourceEvent()},
+	})
+}
+
+func (s *Stream) sourceEvent() SourceEvent {
+	e := SourceEvent{Listeners: len(s.listeners)}
+	if s.source != nil {
+		e.Connected = true
+		e.Addr = s.source.RemoteAddr().String()
+	}
+	return e
+}
+
+// ListenAndIngest accepts sources on addr. Only one source plays at a time;
+// a new one replaces whichever was playing.
+func (s *Stream) ListenAndIngest(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ingest(conn)
+	}
+}
+
+func (s *Stream) ingest(conn net.Conn) {
+	s.mutex.Lock()
+	if s.source != nil {
+		s.source.Close()
+	}
+	s.source = conn
+	s.observers.Notify(s.sourceEvent())
+	s.mutex.Unlock()
+	defer func() {
+		conn.Close()
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.source == conn {
+			s.source = nil
+			s.observers.Notify(SourceEvent{Addr: conn.RemoteAddr().String(), Listeners: len(s.listeners)})
+		}
+	}()
+
+	var tap chan []byte
+	if s.OnSource != nil {
+		tap = make(chan []byte, listenerQueue)
+		defer close(tap)
+		r, w := io.Pipe()
+		go func() {
+			defer w.Close()
+			for chunk := range tap {
+				if _, err := w.Write(chunk); err != nil {
+					// OnSource is done; let the rest go.
+					for range tap {
+					}
+					return
+				}
+			}
+		}()
+		go func() {
+			s.OnSource(r)
+			r.Close()
+		}()
+	}
+	dropping := false
+
+	for {
+		chunk := make([]byte, chunkSize)
+		n, err := conn.Read(chunk)
+		if n > 0 {
+			s.write(chunk[:n])
+			if tap != nil {
+				select {
+				case tap <- chunk[:n]:
+					dropping = false
+				default:
+					if !dropping {
+						fmt.Println("audio source tap fell behind, dropping audio")
+					}
+					dropping = true
+				}
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				fmt.Println("audio source error:", err)
+			}
+			return
+		}
+	}
+}
+
+func (s *Stream) write(chunk []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	burstSize := s.BurstSize
+	if burstSize == 0 {
+		burstSize = defaultBurstSize
+	}
+	s.burst = append(s.burst, chunk...)
+	if len(s.burst) > burstSize {
+		s.burst = append([]byte(nil), s.burst[frameStart(s.burst, len(s.burst)-burstSize):]...)
+	}
+	for ch := range s.listeners {
+		select {
+		case ch <- chunk:
+		default:
+			delete(s.listeners, ch)
+			close(ch)
+		}
+	}
+}
+
+// frameStart returns the first place at or after i that looks like the start
+// of an mp3 frame, so that listeners don't start with half of one.
+func frameStart(b []byte, i int) int {
+	for j := i; j+1 < len(b); j++ {
+		if b[j] == 0xff && b[j+1]&0xe0 == 0xe0 {
+			return j
+		}
+	}
+	return i
+}
+
+func (s *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	contentType := s.ContentType
+	if contentType == "" {
+		contentType = "audio/mpeg"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("icy-name", "space")
+	flusher, _ := w.(http.Flusher)
+
+	ch := make(chan []byte, listenerQueue)
+	s.mutex.Lock()
+	burst := s.burst
+	if s.listeners == nil {
+		s.listeners = map[chan []byte]bool{}
+	}
+	s.listeners[ch] = true
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.listeners[ch] {
+			delete(s.listeners, ch)
+		}
+	}()
+
+	if _, err := w.Write(burst); err != nil {
+		return
+	}
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case chunk, ok := <-ch:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}
+}
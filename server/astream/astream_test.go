@@ -0,0 +1,33 @@
+package astream
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSlowTapDoesntHoldUpListeners(t *testing.T) {
+	stuck := make(chan bool)
+	defer close(stuck)
+	s := &Stream{OnSource: func(r io.Reader) { <-stuck }}
+	source, conn := net.Pipe()
+	defer source.Close()
+	go s.ingest(conn)
+
+	done := make(chan bool)
+	go func() {
+		chunk := make([]byte, chunkSize)
+		for i := 0; i < listenerQueue*4; i++ {
+			if _, err := source.Write(chunk); err != nil {
+				return
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the relay stalled behind a tap that isn't reading")
+	}
+}
@@ -1,17 +1,36 @@
 module github.com/s4y/space
 
-go 1.14
+go 1.18
 
 require (
+	github.com/fxamacker/cbor/v2 v2.4.0
 	github.com/gorilla/websocket v1.4.2
-	github.com/pion/ice/v2 v2.1.12 // indirect
-	github.com/pion/interceptor v0.0.15 // indirect
-	github.com/pion/rtcp v1.2.6
-	github.com/pion/rtp v1.7.1 // indirect
-	github.com/pion/srtp/v2 v2.0.5 // indirect
-	github.com/pion/webrtc/v3 v3.0.32
+	github.com/hajimehoshi/go-mp3 v0.3.4
+	github.com/pion/interceptor v0.1.11
+	github.com/pion/rtcp v1.2.10
+	github.com/pion/rtp v1.7.13
+	github.com/pion/webrtc/v3 v3.1.47
 	github.com/s4y/reserve v1.0.7
-	golang.org/x/crypto v0.0.0-20210813211128-0a44fdfbc16e // indirect
-	golang.org/x/net v0.0.0-20210813160813-60bc85c4be6d // indirect
-	golang.org/x/sys v0.0.0-20211108224332-cbcd623f202e // indirect
+	gopkg.in/hraban/opus.v2 v2.0.0-20230925203106-0188a62cb302
+)
+
+require (
+	github.com/google/uuid v1.3.0 // indirect
+	github.com/pion/datachannel v1.5.2 // indirect
+	github.com/pion/dtls/v2 v2.1.5 // indirect
+	github.com/pion/ice/v2 v2.2.11 // indirect
+	github.com/pion/logging v0.2.2 // indirect
+	github.com/pion/mdns v0.0.5 // indirect
+	github.com/pion/randutil v0.1.0 // indirect
+	github.com/pion/sctp v1.8.2 // indirect
+	github.com/pion/sdp/v3 v3.0.6 // indirect
+	github.com/pion/srtp/v2 v2.0.10 // indirect
+	github.com/pion/stun v0.3.5 // indirect
+	github.com/pion/transport v0.13.1 // indirect
+	github.com/pion/turn/v2 v2.0.8 // indirect
+	github.com/pion/udp v0.1.1 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/crypto v0.0.0-20221010152910-d6f0a8c073c2 // indirect
+	golang.org/x/net v0.0.0-20221004154528-8021a29435af // indirect
+	golang.org/x/sys v0.0.0-20221010170243-090e33056c14 // indirect
 )
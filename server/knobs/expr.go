@@ -0,0 +1,321 @@
+package knobs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// An expr computes a value from the other knobs and the server time, t, in
+// seconds.
+type expr func(knobs map[string]interface{}, t float64) (float64, error)
+
+var exprFuncs = map[string]func(args []float64) (float64, error){
+	"sin":   unaryFunc(math.Sin),
+	"cos":   unaryFunc(math.Cos),
+	"abs":   unaryFunc(math.Abs),
+	"floor": unaryFunc(math.Floor),
+	"ceil":  unaryFunc(math.Ceil),
+	"sqrt":  unaryFunc(math.Sqrt),
+	"pow": func(args []float64) (float64, error) {
+		if len(args) != 2 {
+			return 0, errors.New("pow takes two arguments")
+		}
+		return math.Pow(args[0], args[1]), nil
+	},
+	"min": func(args []float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, errors.New("min needs arguments")
+		}
+		ret := args[0]
+		for _, arg := range args[1:] {
+			ret = math.Min(ret, arg)
+		}
+		return ret, nil
+	},
+	"max": func(args []float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, errors.New("max needs arguments")
+		}
+		ret := args[0]
+		for _, arg := range args[1:] {
+			ret = math.Max(ret, arg)
+		}
+		return ret, nil
+	},
+	"clamp": func(args []float64) (float64, error) {
+		if len(args) != 3 {
+			return 0, errors.New("clamp takes three arguments")
+		}
+		return math.Min(math.Max(args[0], args[1]), args[2]), nil
+	},
+	"mix": func(args []float64) (float64, error) {
+		if len(args) != 3 {
+			return 0, errors.New("mix takes three arguments")
+		}
+		return args[0] + (args[1]-args[0])*args[2], nil
+	},
+}
+
+func unaryFunc(f func(float64) float64) func([]float64) (float64, error) {
+	return func(args []float64) (float64, error) {
+		if len(args) != 1 {
+			return 0, errors.New("expected one argument")
+		}
+		return f(args[0]), nil
+	}
+}
+
+type exprParser struct {
+	src string
+	pos int
+}
+
+// parseExpr understands numbers, knob names, t, pi, + - * / % ^, parentheses
+// and the functions in exprFuncs.
+func parseExpr(src string) (expr, error) {
+	p := exprParser{src: src}
+	e, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos != len(p.src) {
+		return nil, p.errorf("unexpected %q", p.src[p.pos:])
+	}
+	// Knobs can't be infinite or NaN, so 1/0 or sqrt(-1) is an error.
+	return func(knobs map[string]interface{}, t float64) (float64, error) {
+		v, err := e(knobs, t)
+		if err == nil && (math.IsInf(v, 0) || math.IsNaN(v)) {
+			return 0, errors.New(fmt.Sprint("not a finite number: ", v))
+		}
+		return v, err
+	}, nil
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return errors.New(fmt.Sprintf("at %d: ", p.pos) + fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos == len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func binary(a, b expr, op func(a, b float64) float64) expr {
+	return func(knobs map[string]interface{}, t float64) (float64, error) {
+		x, err := a(knobs, t)
+		if err != nil {
+			return 0, err
+		}
+		y, err := b(knobs, t)
+		if err != nil {
+			return 0, err
+		}
+		return op(x, y), nil
+	}
+}
+
+func (p *exprParser) sum() (expr, error) {
+	e, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek() {
+		case '+':
+			p.pos++
+			rhs, err := p.product()
+			if err != nil {
+				return nil, err
+			}
+			e = binary(e, rhs, func(a, b float64) float64 { return a + b })
+		case '-':
+			p.pos++
+			rhs, err := p.product()
+			if err != nil {
+				return nil, err
+			}
+			e = binary(e, rhs, func(a, b float64) float64 { return a - b })
+		default:
+			return e, nil
+		}
+	}
+}
+
+func (p *exprParser) product() (expr, error) {
+	e, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek() {
+		case '*':
+			p.pos++
+			rhs, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			e = binary(e, rhs, func(a, b float64) float64 { return a * b })
+		case '/':
+			p.pos++
+			rhs, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			e = binary(e, rhs, func(a, b float64) float64 { return a / b })
+		case '%':
+			p.pos++
+			rhs, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			e = binary(e, rhs, math.Mod)
+		default:
+			return e, nil
+		}
+	}
+}
+
+func (p *exprParser) unary() (expr, error) {
+	if p.peek() == '-' {
+		p.pos++
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(knobs map[string]interface{}, t float64) (float64, error) {
+			v, err := e(knobs, t)
+			return -v, err
+		}, nil
+	}
+	e, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() == '^' {
+		p.pos++
+		rhs, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		e = binary(e, rhs, math.Pow)
+	}
+	return e, nil
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '.' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))
+}
+
+func (p *exprParser) primary() (expr, error) {
+	c := p.peek()
+	start := p.pos
+	switch {
+	case c == '(':
+		p.pos++
+		e, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("expected )")
+		}
+		p.pos++
+		return e, nil
+	case c == '.' || c >= '0' && c <= '9':
+		for p.pos < len(p.src) {
+			c := p.src[p.pos]
+			// Exponents can have a sign, like 1e-3.
+			sign := (c == '+' || c == '-') && (p.src[p.pos-1] == 'e' || p.src[p.pos-1] == 'E')
+			if !sign && strings.IndexByte("0123456789.eE", c) < 0 {
+				break
+			}
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, p.errorf("bad number %q", p.src[start:p.pos])
+		}
+		return func(map[string]interface{}, float64) (float64, error) { return v, nil }, nil
+	case c != 0 && isIdentChar(c):
+		for p.pos < len(p.src) && isIdentChar(p.src[p.pos]) {
+			p.pos++
+		}
+		name := p.src[start:p.pos]
+		if p.peek() == '(' {
+			return p.call(name)
+		}
+		switch name {
+		case "t":
+			return func(knobs map[string]interface{}, t float64) (float64, error) { return t, nil }, nil
+		case "pi":
+			return func(map[string]interface{}, float64) (float64, error) { return math.Pi, nil }, nil
+		}
+		return func(knobs map[string]interface{}, t float64) (float64, error) {
+			v, ok := toFloat(knobs[name])
+			if !ok {
+				return 0, errors.New(fmt.Sprint("knob isn't a number: ", name))
+			}
+			return v, nil
+		}, nil
+	case c == 0:
+		return nil, p.errorf("unexpected end")
+	}
+	return nil, p.errorf("unexpected %q", string(c))
+}
+
+func (p *exprParser) call(name string) (expr, error) {
+	f, ok := exprFuncs[name]
+	if !ok {
+		return nil, p.errorf("unknown function %s", name)
+	}
+	p.pos++
+	args := []expr{}
+	if p.peek() == ')' {
+		p.pos++
+	} else {
+		for {
+			arg, err := p.sum()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if c := p.peek(); c == ',' {
+				p.pos++
+			} else if c == ')' {
+				p.pos++
+				break
+			} else {
+				return nil, p.errorf("expected , or )")
+			}
+		}
+	}
+	return func(knobs map[string]interface{}, t float64) (float64, error) {
+		values := make([]float64, len(args))
+		for i, arg := range args {
+			v, err := arg(knobs, t)
+			if err != nil {
+				return 0, err
+			}
+			values[i] = v
+		}
+		v, err := f(values)
+		if err != nil {
+			return 0, errors.New(fmt.Sprint(name, ": ", err))
+		}
+		return v, nil
+	}, nil
+}
@@ -0,0 +1,56 @@
+package knobs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestExpr(t *testing.T) {
+	knobs := map[string]interface{}{"a": 2.0, "b": "x"}
+	for src, want := range map[string]float64{
+		"1e-3":          0.001,
+		"2.5E+2 - 50":   200,
+		"1e3-1":         999,
+		"a ^ 2 * -1":    -4,
+		"min(a, 3, 1)":  1,
+		"(1 + 2) % 2":   1,
+		"mix(0, 10, t)": 5,
+	} {
+		e, err := parseExpr(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if v, err := e(knobs, 0.5); err != nil || math.Abs(v-want) > 1e-9 {
+			t.Errorf("%s = %v, %v; want %v", src, v, err, want)
+		}
+	}
+	for _, src := range []string{"1/0", "sqrt(-1)", "b + 1", "-a / 0"} {
+		e, err := parseExpr(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if v, err := e(knobs, 0); err == nil {
+			t.Errorf("%s = %v, want an error", src, v)
+		}
+	}
+	for _, src := range []string{"1e", "(1", "nope(1)", "1 2"} {
+		if _, err := parseExpr(src); err == nil {
+			t.Errorf("%s parsed, want an error", src)
+		}
+	}
+}
+
+func TestModulatorRate(t *testing.T) {
+	var k Knobs
+	defer k.Stop()
+	for _, rate := range []float64{-1, math.Inf(1), math.NaN(), 1e-300, 1000} {
+		if err := k.AddModulator(Modulator{Knob: "a", Shape: "sine", UpdateRate: rate}); err == nil {
+			t.Errorf("modulator with updateRate %v was added", rate)
+		}
+	}
+	if err := k.AddModulator(Modulator{Knob: "a", Shape: "sine"}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,93 @@
+package knobs
+
+// Knobs remember this many changes for undo.
+const historyLimit = 1000
+
+// A HistoryEntry is one change made with SetBy, at a server time in
+// milliseconds. Old is nil if the knob wasn't set before. Scenes, takes and
+// modulators show up as "scene <name>", "take <name>" and "modulator", once
+// per knob they start moving.
+type HistoryEntry struct {
+	At   int64       `json:"at"`
+	Who  string      `json:"who"`
+	Name string      `json:"name"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+
+	// stop stops whatever is still moving the knob, so undoing sticks.
+	stop func()
+}
+
+func (k *Knobs) remember(entry HistoryEntry) {
+	k.history = append(k.history, entry)
+	if len(k.history) > historyLimit {
+		k.history = append([]HistoryEntry(nil), k.history[len(k.history)-historyLimit:]...)
+	}
+}
+
+// History returns up to limit of the latest changes, oldest first, to the
+// named knob or to every knob if name is empty.
+func (k *Knobs) History(name string, limit int) []HistoryEntry {
+	k.knobsMutex.RLock()
+	defer k.knobsMutex.RUnlock()
+	ret := []HistoryEntry{}
+	for i := len(k.history) - 1; i >= 0 && (limit <= 0 || len(ret) < limit); i-- {
+		if name == "" || k.history[i].Name == name {
+			ret = append(ret, k.history[i])
+		}
+	}
+	for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+		ret[i], ret[j] = ret[j], ret[i]
+	}
+	return ret
+}
+
+// undo puts back knobs the way they were before the changes in history after
+// keep, and forgets those changes. Knobs that weren't set before are left
+// alone.
+func (k *Knobs) undo(keep func(entries []HistoryEntry) int) []HistoryEntry {
+	k.knobsMutex.Lock()
+	n := keep(k.history)
+	undone := append([]HistoryEntry(nil), k.history[n:]...)
+	k.history = k.history[:n]
+	k.knobsMutex.Unlock()
+	for i := len(undone) - 1; i >= 0; i-- {
+		if undone[i].stop != nil {
+			undone[i].stop()
+		}
+		if undone[i].Old != nil {
+			k.Set(undone[i].Name, undone[i].Old)
+		}
+	}
+	return undone
+}
+
+// Undo reverts the last count changes, and returns them. It does nothing if
+// count isn't positive.
+func (k *Knobs) Undo(count int) []HistoryEntry {
+	if count <= 0 {
+		return nil
+	}
+	return k.undo(func(entries []HistoryEntry) int {
+		if count > len(entries) {
+			return 0
+		}
+		return len(entries) - count
+	})
+}
+
+// RevertTo reverts every change made after the server time at, in
+// milliseconds, and returns them. It does nothing if at isn't positive, to
+// keep a missing time from reverting everything.
+func (k *Knobs) RevertTo(at int64) []HistoryEntry {
+	if at <= 0 {
+		return nil
+	}
+	return k.undo(func(entries []HistoryEntry) int {
+		n := len(entries)
+		for n > 0 && entries[n-1].At > at {
+			n--
+		}
+		return n
+	})
+}
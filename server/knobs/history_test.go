@@ -0,0 +1,50 @@
+package knobs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUndo(t *testing.T) {
+	var k Knobs
+	k.SetBy("a", 1.0, "alice")
+	k.SetBy("a", 2.0, "bob")
+	k.SetBy("b", "x", "bob")
+
+	if undone := k.Undo(0); len(undone) != 0 {
+		t.Errorf("Undo(0) undid %d changes", len(undone))
+	}
+	if undone := k.RevertTo(0); len(undone) != 0 {
+		t.Errorf("RevertTo(0) undid %d changes", len(undone))
+	}
+	if undone := k.Undo(1); len(undone) != 1 || undone[0].Name != "b" {
+		t.Errorf("Undo(1) undid %v", undone)
+	}
+	k.Undo(1)
+	if v := k.Get()["a"]; v != 1.0 {
+		t.Errorf("a is %v after undo, want 1", v)
+	}
+}
+
+func TestUndoScene(t *testing.T) {
+	var k Knobs
+	k.Set("level", 1.0)
+	k.Set("mode", "wild")
+	k.SaveScene("loud")
+	k.SetBy("level", 0.0, "alice")
+	k.SetBy("mode", "calm", "alice")
+	if err := k.RecallScene("loud", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	history := k.History("", 0)
+	if len(history) != 4 || history[2].Who != "scene loud" || history[3].Who != "scene loud" {
+		t.Fatalf("history after recalling a scene is %v", history)
+	}
+
+	// Undoing the fade stops it, too.
+	k.Undo(2)
+	time.Sleep(100 * time.Millisecond)
+	if knobs := k.Get(); knobs["level"] != 0.0 || knobs["mode"] != "calm" {
+		t.Errorf("knobs are %v after undoing a scene", knobs)
+	}
+}
@@ -2,6 +2,8 @@ package knobs
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
 
 	"github.com/s4y/space/util"
@@ -12,39 +14,138 @@ type KnobMessage struct {
 	Value interface{} `json:"value"`
 }
 
-type KnobEventType int
-
-const (
-	KnobChanged KnobEventType = iota
-)
-
 type Knobs struct {
-	observers util.Observers
+	changed util.Observers[KnobMessage]
 
 	knobsMutex sync.RWMutex
 	knobs      map[string]interface{}
+	store      Store
+	schema     Schema
+	scenes     map[string]Scene
+	sceneStore Store
+	cancelFade context.CancelFunc
+
+	takes          map[string]Take
+	takeStore      Store
+	recording      *recording
+	cancelPlayback context.CancelFunc
+
+	modulators       map[string]Modulator
+	cancelModulators map[string]context.CancelFunc
+	modulatorStore   Store
+
+	history []HistoryEntry
 }
 
-func (k *Knobs) Observe(ctx context.Context, e KnobEventType, cb interface{}) {
-	k.observers.Add(ctx, e, cb)
-	switch e {
-	case KnobChanged:
-		changeCb := cb.(func(string, interface{}))
-		for name, value := range k.Get() {
-			changeCb(name, value)
+// ObserveChanged calls cb whenever a knob changes, and with every knob's
+// current value first.
+func (k *Knobs) ObserveChanged(ctx context.Context, cb func(KnobMessage), opts ...util.Options[KnobMessage]) util.Subscription {
+	var o util.Options[KnobMessage]
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	k.knobsMutex.RLock()
+	defer k.knobsMutex.RUnlock()
+	for name, value := range k.knobs {
+		o.Initial = append(o.Initial, KnobMessage{name, value})
+	}
+	return k.changed.Add(ctx, cb, o)
+}
+
+// DroppedEvents returns how many changes observers have missed because they
+// fell behind.
+func (k *Knobs) DroppedEvents() uint64 {
+	return k.changed.Dropped()
+}
+
+// SetStore loads knob values from store, replacing any that are already set,
+// and saves every change from now on to it.
+func (k *Knobs) SetStore(store Store) error {
+	values, err := store.Load()
+	if err != nil {
+		return err
+	}
+	k.knobsMutex.Lock()
+	k.store = store
+	k.knobsMutex.Unlock()
+	for name, value := range values {
+		if err := k.Set(name, value); err != nil {
+			fmt.Println("ignoring saved knob:", err)
 		}
 	}
+	return nil
+}
+
+// Set changes a knob's value, after checking it against the schema (see
+// SetSchema).
+func (k *Knobs) Set(name string, value interface{}) error {
+	return k.SetBy(name, value, "")
+}
+
+// SetBy is like Set, but remembers who changed the knob in its history (see
+// History). Changes made by nobody in particular aren't remembered.
+func (k *Knobs) SetBy(name string, value interface{}, who string) error {
+	if who == "" {
+		return k.set(name, value, nil)
+	}
+	return k.set(name, value, &HistoryEntry{Who: who})
 }
 
-func (k *Knobs) Set(name string, value interface{}) {
+// set changes a knob, and remembers the change as entry, if it isn't nil,
+// once the rest of entry is filled in.
+func (k *Knobs) set(name string, value interface{}, entry *HistoryEntry) error {
 	k.knobsMutex.Lock()
+	if spec, ok := k.schema[name]; ok {
+		var err error
+		if value, err = spec.Check(value); err != nil {
+			k.knobsMutex.Unlock()
+			return errors.New(fmt.Sprint(name, ": ", err))
+		}
+	}
 	if k.knobs == nil {
 		k.knobs = make(map[string]interface{})
 	}
+	if entry != nil {
+		entry.At, entry.Name, entry.Old, entry.New = now(), name, k.knobs[name], value
+		k.remember(*entry)
+	}
 	k.knobs[name] = value
+	// Takes are recorded here, not by an observer, so they don't miss
+	// changes or get their timing wrong when observers fall behind.
+	if rec := k.recording; rec != nil {
+		rec.take.Events = append(rec.take.Events, TakeEvent{now() - rec.take.Start, name, value})
+		if len(rec.take.Events) >= maxTakeEvents {
+			fmt.Println("take", rec.name, "hit", maxTakeEvents, "events and stopped recording")
+			k.stopRecording()
+		}
+	}
+	if k.store != nil {
+		values := make(map[string]interface{})
+		for k, v := range k.knobs {
+			values[k] = v
+		}
+		if err := k.store.Save(values); err != nil {
+			fmt.Println("failed to save knobs:", err)
+		}
+	}
 	k.knobsMutex.Unlock()
-	for _, o := range k.observers.Get(KnobChanged) {
-		o.(func(string, interface{}))(name, value)
+	k.changed.Notify(KnobMessage{name, value})
+	return nil
+}
+
+// Stop stops everything that moves knobs on its own: scene crossfades, take
+// playback and modulators.
+func (k *Knobs) Stop() {
+	k.knobsMutex.Lock()
+	defer k.knobsMutex.Unlock()
+	for _, cancel := range []context.CancelFunc{k.cancelFade, k.cancelPlayback} {
+		if cancel != nil {
+			cancel()
+		}
+	}
+	k.cancelFade, k.cancelPlayback = nil, nil
+	for _, cancel := range k.cancelModulators {
+		cancel()
 	}
 }
 
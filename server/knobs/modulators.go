@@ -0,0 +1,204 @@
+package knobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Modulators set their knobs this many times per second unless they say
+// otherwise.
+const defaultModulatorRate = 30
+
+// Modulators can't ask to set their knobs any faster or slower than this.
+const (
+	minModulatorRate = 0.01
+	maxModulatorRate = 60
+)
+
+// A Modulator moves a knob on its own. The "sine", "triangle", "square" and
+// "saw" shapes swing Depth above and below Center, Rate times per second, in
+// step with the server clock. "random" wanders around the same range, about
+// as fast. "expr" sets the knob to Expr, which can use other knobs and the
+// server time, t, in seconds: e.g. "world.motion * (0.5 + sin(t) / 2)".
+// UpdateRate is how many times per second the knob gets set, between
+// minModulatorRate and maxModulatorRate.
+type Modulator struct {
+	Knob       string  `json:"knob"`
+	Shape      string  `json:"shape"`
+	Rate       float64 `json:"rate,omitempty"`
+	Depth      float64 `json:"depth,omitempty"`
+	Center     float64 `json:"center,omitempty"`
+	Phase      float64 `json:"phase,omitempty"`
+	Expr       string  `json:"expr,omitempty"`
+	UpdateRate float64 `json:"updateRate,omitempty"`
+}
+
+func (m Modulator) compile() (expr, error) {
+	wave := func(f func(x float64) float64) expr {
+		return func(knobs map[string]interface{}, t float64) (float64, error) {
+			x := m.Rate*t + m.Phase
+			return m.Center + m.Depth*f(x-math.Floor(x)), nil
+		}
+	}
+	switch m.Shape {
+	case "sine":
+		return wave(func(x float64) float64 { return math.Sin(2 * math.Pi * x) }), nil
+	case "triangle":
+		return wave(func(x float64) float64 { return 1 - 4*math.Abs(x-0.5) }), nil
+	case "square":
+		return wave(func(x float64) float64 {
+			if x < 0.5 {
+				return 1
+			}
+			return -1
+		}), nil
+	case "saw":
+		return wave(func(x float64) float64 { return 2*x - 1 }), nil
+	case "random":
+		v := m.Center
+		last := math.NaN()
+		return func(knobs map[string]interface{}, t float64) (float64, error) {
+			if !math.IsNaN(last) {
+				v += m.Depth * math.Sqrt(m.Rate*(t-last)) * rand.NormFloat64()
+				v = math.Max(m.Center-m.Depth, math.Min(m.Center+m.Depth, v))
+			}
+			last = t
+			return v, nil
+		}, nil
+	case "expr":
+		return parseExpr(m.Expr)
+	}
+	return nil, errors.New(fmt.Sprint("unknown modulator shape: ", m.Shape))
+}
+
+// SetModulatorStore loads modulators from store and starts them, and saves
+// every change to them from now on to it.
+func (k *Knobs) SetModulatorStore(store Store) error {
+	values, err := store.Load()
+	if err != nil {
+		return err
+	}
+	k.knobsMutex.Lock()
+	k.modulatorStore = store
+	k.knobsMutex.Unlock()
+	for _, value := range values {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		var m Modulator
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		if err := k.AddModulator(m); err != nil {
+			fmt.Println("ignoring saved modulator:", err)
+		}
+	}
+	return nil
+}
+
+func (k *Knobs) saveModulators() {
+	if k.modulatorStore == nil {
+		return
+	}
+	values := map[string]interface{}{}
+	for name, m := range k.modulators {
+		values[name] = m
+	}
+	if err := k.modulatorStore.Save(values); err != nil {
+		fmt.Println("failed to save modulators:", err)
+	}
+}
+
+// AddModulator starts moving a knob, replacing any modulator already on it.
+func (k *Knobs) AddModulator(m Modulator) error {
+	f, err := m.compile()
+	if err != nil {
+		return errors.New(fmt.Sprint(m.Knob, ": ", err))
+	}
+	rate := m.UpdateRate
+	if rate == 0 {
+		rate = defaultModulatorRate
+	} else if !(rate >= minModulatorRate && rate <= maxModulatorRate) {
+		return errors.New(fmt.Sprint(m.Knob, ": updateRate must be between ", minModulatorRate, " and ", maxModulatorRate))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	k.knobsMutex.Lock()
+	if k.modulators == nil {
+		k.modulators = map[string]Modulator{}
+		k.cancelModulators = map[string]context.CancelFunc{}
+	}
+	if cancel := k.cancelModulators[m.Knob]; cancel != nil {
+		cancel()
+	}
+	k.modulators[m.Knob] = m
+	k.cancelModulators[m.Knob] = cancel
+	k.saveModulators()
+	k.knobsMutex.Unlock()
+
+	// The first value goes into the history, so undoing it takes the
+	// modulator off (unless it's been replaced since) and puts the knob back.
+	entry := &HistoryEntry{Who: "modulator", stop: func() {
+		if ctx.Err() == nil {
+			k.RemoveModulator(m.Knob)
+		}
+	}}
+	go func() {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		lastErr := ""
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				t := float64(now.UnixNano()) / float64(time.Second)
+				v, err := f(k.Get(), t)
+				if err == nil {
+					err = k.set(m.Knob, v, entry)
+					if err == nil {
+						entry = nil
+					}
+				}
+				// Say what went wrong once, not every tick.
+				if err != nil && err.Error() != lastErr {
+					fmt.Println("modulator", m.Knob, "failed:", err)
+				}
+				lastErr = ""
+				if err != nil {
+					lastErr = err.Error()
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// RemoveModulator stops moving a knob, and leaves it where it is.
+func (k *Knobs) RemoveModulator(knob string) {
+	k.knobsMutex.Lock()
+	defer k.knobsMutex.Unlock()
+	if cancel := k.cancelModulators[knob]; cancel != nil {
+		cancel()
+	}
+	delete(k.modulators, knob)
+	delete(k.cancelModulators, knob)
+	k.saveModulators()
+}
+
+func (k *Knobs) Modulators() []Modulator {
+	k.knobsMutex.RLock()
+	defer k.knobsMutex.RUnlock()
+	ret := []Modulator{}
+	for _, m := range k.modulators {
+		ret = append(ret, m)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Knob < ret[j].Knob })
+	return ret
+}
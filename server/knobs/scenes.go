@@ -0,0 +1,145 @@
+package knobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Knobs move this many times per second while crossfading to a scene.
+const sceneFadeRate = 30
+
+// A Scene is a set of knob values that can be recalled all at once.
+type Scene map[string]interface{}
+
+// SetSceneStore loads scenes from store, and saves every change to them from
+// now on to it.
+func (k *Knobs) SetSceneStore(store Store) error {
+	values, err := store.Load()
+	if err != nil {
+		return err
+	}
+	k.knobsMutex.Lock()
+	defer k.knobsMutex.Unlock()
+	k.sceneStore = store
+	if k.scenes == nil {
+		k.scenes = map[string]Scene{}
+	}
+	for name, value := range values {
+		if scene, ok := value.(map[string]interface{}); ok {
+			k.scenes[name] = scene
+		}
+	}
+	return nil
+}
+
+func (k *Knobs) saveScenes() {
+	if k.sceneStore == nil {
+		return
+	}
+	values := map[string]interface{}{}
+	for name, scene := range k.scenes {
+		values[name] = scene
+	}
+	if err := k.sceneStore.Save(values); err != nil {
+		fmt.Println("failed to save scenes:", err)
+	}
+}
+
+// SaveScene saves the current value of every knob as a scene.
+func (k *Knobs) SaveScene(name string) {
+	scene := Scene(k.Get())
+	k.knobsMutex.Lock()
+	defer k.knobsMutex.Unlock()
+	if k.scenes == nil {
+		k.scenes = map[string]Scene{}
+	}
+	k.scenes[name] = scene
+	k.saveScenes()
+}
+
+func (k *Knobs) DeleteScene(name string) {
+	k.knobsMutex.Lock()
+	defer k.knobsMutex.Unlock()
+	delete(k.scenes, name)
+	k.saveScenes()
+}
+
+func (k *Knobs) Scenes() map[string]Scene {
+	k.knobsMutex.RLock()
+	defer k.knobsMutex.RUnlock()
+	ret := map[string]Scene{}
+	for name, scene := range k.scenes {
+		ret[name] = scene
+	}
+	return ret
+}
+
+// RecallScene sets every knob in a scene. Numeric knobs glide from their
+// current value over duration; everything else jumps right away. Recalling
+// another scene stops any crossfade in progress.
+func (k *Knobs) RecallScene(name string, duration time.Duration) error {
+	k.knobsMutex.Lock()
+	scene, ok := k.scenes[name]
+	if k.cancelFade != nil {
+		k.cancelFade()
+		k.cancelFade = nil
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if ok && duration > 0 {
+		ctx, cancel = context.WithCancel(context.Background())
+		k.cancelFade = cancel
+	}
+	k.knobsMutex.Unlock()
+	if !ok {
+		return errors.New(fmt.Sprint("no such scene: ", name))
+	}
+
+	from := map[string]float64{}
+	to := map[string]float64{}
+	current := k.Get()
+	for knob, value := range scene {
+		a, aOk := current[knob].(float64)
+		b, bOk := value.(float64)
+		if duration > 0 && aOk && bOk {
+			from[knob], to[knob] = a, b
+		} else {
+			k.set(knob, value, &HistoryEntry{Who: "scene " + name})
+		}
+	}
+	if len(from) == 0 {
+		return nil
+	}
+	// Fading knobs go into the history once, headed where they're going.
+	k.knobsMutex.Lock()
+	for knob := range from {
+		k.remember(HistoryEntry{now(), "scene " + name, knob, from[knob], to[knob], cancel})
+	}
+	k.knobsMutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(time.Second / sceneFadeRate)
+		defer ticker.Stop()
+		start := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				t := float64(now.Sub(start)) / float64(duration)
+				if t > 1 {
+					t = 1
+				}
+				for knob := range from {
+					k.Set(knob, from[knob]+(to[knob]-from[knob])*t)
+				}
+				if t == 1 {
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
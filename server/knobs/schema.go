@@ -0,0 +1,100 @@
+package knobs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// KnobSpec describes what values a knob can take. Type is "number" (the
+// default), "bool" or "string". Numbers are clamped to Min and Max and
+// rounded to Step, where given.
+type KnobSpec struct {
+	Type        string      `json:"type,omitempty"`
+	Min         *float64    `json:"min,omitempty"`
+	Max         *float64    `json:"max,omitempty"`
+	Step        float64     `json:"step,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+	Description string      `json:"description,omitempty"`
+}
+
+type Schema map[string]KnobSpec
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// Check returns the value a knob should actually be set to, or an error if it
+// can't take value at all.
+func (spec KnobSpec) Check(value interface{}) (interface{}, error) {
+	switch spec.Type {
+	case "", "number":
+		f, ok := toFloat(value)
+		if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, errors.New(fmt.Sprint("expected a number, got ", value))
+		}
+		if spec.Step > 0 {
+			base := 0.0
+			if spec.Min != nil {
+				base = *spec.Min
+			}
+			f = base + math.Round((f-base)/spec.Step)*spec.Step
+		}
+		if spec.Min != nil && f < *spec.Min {
+			f = *spec.Min
+		}
+		if spec.Max != nil && f > *spec.Max {
+			f = *spec.Max
+		}
+		return f, nil
+	case "bool":
+		if _, ok := value.(bool); !ok {
+			return nil, errors.New(fmt.Sprint("expected a bool, got ", value))
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return nil, errors.New(fmt.Sprint("expected a string, got ", value))
+		}
+	default:
+		return nil, errors.New(fmt.Sprint("unknown knob type: ", spec.Type))
+	}
+	return value, nil
+}
+
+// SetSchema makes Set check values for the knobs in schema, and sets any that
+// aren't set yet to their defaults. Knobs that aren't in the schema can still
+// be set to anything.
+func (k *Knobs) SetSchema(schema Schema) {
+	k.knobsMutex.Lock()
+	k.schema = schema
+	current := map[string]bool{}
+	for name := range k.knobs {
+		current[name] = true
+	}
+	k.knobsMutex.Unlock()
+	for name, spec := range schema {
+		if spec.Default != nil && !current[name] {
+			if err := k.Set(name, spec.Default); err != nil {
+				fmt.Println("bad default for knob", name, err)
+			}
+		}
+	}
+}
+
+func (k *Knobs) Schema() Schema {
+	k.knobsMutex.RLock()
+	defer k.knobsMutex.RUnlock()
+	return k.schema
+}
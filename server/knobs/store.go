@@ -0,0 +1,113 @@
+package knobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Store keeps knob values somewhere that outlives the server.
+type Store interface {
+	Load() (map[string]interface{}, error)
+	Save(map[string]interface{}) error
+}
+
+// FileStore saves knobs as JSON to Path, at most once every Delay.
+type FileStore struct {
+	Path  string
+	Delay time.Duration
+
+	mutex   sync.Mutex
+	pending map[string]interface{}
+	timer   *time.Timer
+	// Held while taking pending and writing it, so that an older write
+	// can't land after a newer one.
+	writing sync.Mutex
+}
+
+// NewFileStore makes a FileStore, and the directory it saves to if needed.
+func NewFileStore(path string, delay time.Duration) (*FileStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{Path: path, Delay: delay}, nil
+}
+
+func (s *FileStore) Load() (map[string]interface{}, error) {
+	ret := map[string]interface{}{}
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return ret, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *FileStore) Save(values map[string]interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pending = values
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.Delay, s.flush)
+	}
+	return nil
+}
+
+func (s *FileStore) flush() {
+	if err := s.Flush(); err != nil {
+		fmt.Println("failed to save", s.Path+":", err)
+	}
+}
+
+// Flush writes values that are waiting on Delay now, like before the server
+// exits.
+func (s *FileStore) Flush() error {
+	s.writing.Lock()
+	defer s.writing.Unlock()
+	s.mutex.Lock()
+	values := s.pending
+	s.pending = nil
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.mutex.Unlock()
+	if values == nil {
+		return nil
+	}
+	return s.write(values)
+}
+
+// write replaces the file all at once, so that a crash mid-write doesn't
+// leave half of it behind.
+func (s *FileStore) write(values map[string]interface{}) error {
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.Path)
+}
@@ -0,0 +1,33 @@
+package knobs
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStoreFlush(t *testing.T) {
+	s, err := NewFileStore(filepath.Join(t.TempDir(), "knobs.json"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(map[string]interface{}{"level": 1.0}); err != nil {
+		t.Fatal(err)
+	}
+	if values, err := s.Load(); err != nil || len(values) != 0 {
+		t.Fatalf("loaded %v, %v before the delay", values, err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if values, err := s.Load(); err != nil || values["level"] != 1.0 {
+		t.Errorf("loaded %v, %v after flushing", values, err)
+	}
+	// Nothing's pending now, so flushing again leaves the file alone.
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if values, err := s.Load(); err != nil || values["level"] != 1.0 {
+		t.Errorf("loaded %v, %v after flushing twice", values, err)
+	}
+}
@@ -0,0 +1,254 @@
+package knobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A TakeEvent is one knob change, At milliseconds into a take.
+type TakeEvent struct {
+	At    int64       `json:"at"`
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+// A Take is a recording of knob changes. Start is the server time, in
+// milliseconds, when recording started, and the first events in it are the
+// values every knob had then.
+type Take struct {
+	Start    int64       `json:"start"`
+	Duration int64       `json:"duration"`
+	Events   []TakeEvent `json:"events"`
+}
+
+type TakeInfo struct {
+	Name     string `json:"name"`
+	Start    int64  `json:"start"`
+	Duration int64  `json:"duration"`
+	Events   int    `json:"events"`
+}
+
+// Takes stop recording on their own once they get this long or have this
+// many events, so a forgotten one doesn't grow forever.
+const (
+	maxTakeLength = 2 * time.Hour
+	maxTakeEvents = 100000
+)
+
+type recording struct {
+	name  string
+	take  Take
+	timer *time.Timer
+}
+
+func now() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// SetTakeStore loads takes from store, and saves every change to them from
+// now on to it.
+func (k *Knobs) SetTakeStore(store Store) error {
+	values, err := store.Load()
+	if err != nil {
+		return err
+	}
+	k.knobsMutex.Lock()
+	defer k.knobsMutex.Unlock()
+	k.takeStore = store
+	if k.takes == nil {
+		k.takes = map[string]Take{}
+	}
+	for name, value := range values {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		var take Take
+		if err := json.Unmarshal(data, &take); err != nil {
+			return err
+		}
+		k.takes[name] = take
+	}
+	return nil
+}
+
+func (k *Knobs) saveTakes() {
+	if k.takeStore == nil {
+		return
+	}
+	values := map[string]interface{}{}
+	for name, take := range k.takes {
+		values[name] = take
+	}
+	if err := k.takeStore.Save(values); err != nil {
+		fmt.Println("failed to save takes:", err)
+	}
+}
+
+// StartRecording records every knob change into a new take until
+// StopRecording is called, or until it hits maxTakeLength or maxTakeEvents.
+func (k *Knobs) StartRecording(name string) error {
+	k.knobsMutex.Lock()
+	defer k.knobsMutex.Unlock()
+	if k.recording != nil {
+		return errors.New(fmt.Sprint("already recording ", k.recording.name))
+	}
+	rec := &recording{name: name, take: Take{Start: now()}}
+	for name, value := range k.knobs {
+		rec.take.Events = append(rec.take.Events, TakeEvent{0, name, value})
+	}
+	rec.timer = time.AfterFunc(maxTakeLength, func() {
+		k.knobsMutex.Lock()
+		defer k.knobsMutex.Unlock()
+		if k.recording == rec {
+			fmt.Println("take", rec.name, "hit", maxTakeLength, "and stopped recording")
+			k.stopRecording()
+		}
+	})
+	k.recording = rec
+	return nil
+}
+
+// StopRecording saves the take being recorded, replacing any with the same
+// name.
+func (k *Knobs) StopRecording() (TakeInfo, error) {
+	k.knobsMutex.Lock()
+	defer k.knobsMutex.Unlock()
+	return k.stopRecording()
+}
+
+// stopRecording must be called with knobsMutex held.
+func (k *Knobs) stopRecording() (TakeInfo, error) {
+	rec := k.recording
+	if rec == nil {
+		return TakeInfo{}, errors.New("not recording")
+	}
+	rec.timer.Stop()
+	k.recording = nil
+	rec.take.Duration = now() - rec.take.Start
+	if k.takes == nil {
+		k.takes = map[string]Take{}
+	}
+	k.takes[rec.name] = rec.take
+	k.saveTakes()
+	return TakeInfo{rec.name, rec.take.Start, rec.take.Duration, len(rec.take.Events)}, nil
+}
+
+// Recording returns the name of the take being recorded, if any.
+func (k *Knobs) Recording() (string, bool) {
+	k.knobsMutex.RLock()
+	defer k.knobsMutex.RUnlock()
+	if k.recording == nil {
+		return "", false
+	}
+	return k.recording.name, true
+}
+
+func (k *Knobs) DeleteTake(name string) {
+	k.knobsMutex.Lock()
+	defer k.knobsMutex.Unlock()
+	delete(k.takes, name)
+	k.saveTakes()
+}
+
+func (k *Knobs) Takes() []TakeInfo {
+	k.knobsMutex.RLock()
+	defer k.knobsMutex.RUnlock()
+	ret := []TakeInfo{}
+	for name, take := range k.takes {
+		ret = append(ret, TakeInfo{name, take.Start, take.Duration, len(take.Events)})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// PlayTake sets knobs the way they changed in a take, starting at the server
+// time start (in milliseconds), which can be in the past to join a take
+// partway through. Looped takes start over every time they end. Playing
+// another take stops this one.
+func (k *Knobs) PlayTake(name string, start int64, loop bool) error {
+	k.knobsMutex.Lock()
+	take, ok := k.takes[name]
+	if ok && loop && take.Duration <= 0 {
+		k.knobsMutex.Unlock()
+		return errors.New(fmt.Sprint("can't loop empty take: ", name))
+	}
+	if k.cancelPlayback != nil {
+		k.cancelPlayback()
+		k.cancelPlayback = nil
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if ok {
+		ctx, cancel = context.WithCancel(context.Background())
+		k.cancelPlayback = cancel
+	}
+	k.knobsMutex.Unlock()
+	if !ok {
+		return errors.New(fmt.Sprint("no such take: ", name))
+	}
+
+	// The first change to each knob goes into the history, so undoing it
+	// stops the take and puts the knob back the way it was before.
+	touched := map[string]bool{}
+	set := func(knob string, value interface{}) {
+		if touched[knob] {
+			k.Set(knob, value)
+			return
+		}
+		touched[knob] = true
+		k.set(knob, value, &HistoryEntry{Who: "take " + name, stop: cancel})
+	}
+
+	wait := func(until int64) bool {
+		timer := time.NewTimer(time.Duration(until-now()) * time.Millisecond)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		}
+	}
+	go func() {
+		for {
+			if loop && start+take.Duration <= now() {
+				start += (now() - start) / take.Duration * take.Duration
+			}
+			// Jump straight to where every knob should be by now, if the
+			// take started in the past.
+			i := 0
+			caughtUp := map[string]interface{}{}
+			for ; i < len(take.Events) && start+take.Events[i].At <= now(); i++ {
+				caughtUp[take.Events[i].Name] = take.Events[i].Value
+			}
+			for name, value := range caughtUp {
+				set(name, value)
+			}
+			for ; i < len(take.Events); i++ {
+				if !wait(start + take.Events[i].At) {
+					return
+				}
+				set(take.Events[i].Name, take.Events[i].Value)
+			}
+			if !loop || !wait(start+take.Duration) {
+				return
+			}
+			start += take.Duration
+		}
+	}()
+	return nil
+}
+
+func (k *Knobs) StopPlayback() {
+	k.knobsMutex.Lock()
+	defer k.knobsMutex.Unlock()
+	if k.cancelPlayback != nil {
+		k.cancelPlayback()
+		k.cancelPlayback = nil
+	}
+}
@@ -0,0 +1,47 @@
+package knobs
+
+import "testing"
+
+func TestRecordingKeepsEveryChange(t *testing.T) {
+	var k Knobs
+	k.Set("level", -1.0)
+	if err := k.StartRecording("ramp"); err != nil {
+		t.Fatal(err)
+	}
+	// Far more changes than an observer's queue holds.
+	for i := 0; i < 1000; i++ {
+		k.Set("level", float64(i))
+	}
+	info, err := k.StopRecording()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Events != 1001 {
+		t.Fatalf("recorded %d events, want 1001", info.Events)
+	}
+	events := k.takes["ramp"].Events
+	for i, event := range events {
+		if event.Value != float64(i-1) {
+			t.Fatalf("event %d is %v, want %d", i, event.Value, i-1)
+		}
+		if i > 0 && event.At < events[i-1].At {
+			t.Fatalf("event %d is at %d, before %d", i, event.At, events[i-1].At)
+		}
+	}
+}
+
+func TestRecordingStopsAtMaxEvents(t *testing.T) {
+	var k Knobs
+	if err := k.StartRecording("forgotten"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxTakeEvents+10; i++ {
+		k.Set("level", float64(i))
+	}
+	if _, recording := k.Recording(); recording {
+		t.Error("still recording")
+	}
+	if n := len(k.takes["forgotten"].Events); n != maxTakeEvents {
+		t.Errorf("take has %d events, want %d", n, maxTakeEvents)
+	}
+}
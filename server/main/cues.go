@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/s4y/space/knobs"
+	"github.com/s4y/space/world"
+)
+
+// A Cue is a room command (see runRoomCommand) scheduled for a moment in
+// server time, in milliseconds like the clock.
+type Cue struct {
+	Id   uint32     `json:"id"`
+	At   int64      `json:"at"`
+	Type string     `json:"type"`
+	Body world.Body `json:"body"`
+}
+
+type CueList struct {
+	Fire func(Cue)
+
+	mutex  sync.Mutex
+	seq    uint32
+	cues   map[uint32]Cue
+	timers map[uint32]*time.Timer
+	store  knobs.Store
+}
+
+func serverTime() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// Load schedules the cues saved in store, and saves every change from now on
+// to it. Cues that should have fired while the server was down fire once
+// now, in order, so the room ends up the way it would have been, except for
+// broadcasts, which would be news to nobody by now and are dropped.
+func (c *CueList) Load(store knobs.Store) error {
+	values, err := store.Load()
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.store = store
+	missed := []Cue{}
+	for _, value := range values {
+		data, err := json.Marshal(value)
+		if err != nil {
+			c.mutex.Unlock()
+			return err
+		}
+		var cue Cue
+		if err := json.Unmarshal(data, &cue); err != nil {
+			c.mutex.Unlock()
+			return err
+		}
+		if cue.Id > c.seq {
+			c.seq = cue.Id
+		}
+		if cue.At < serverTime() {
+			missed = append(missed, cue)
+			continue
+		}
+		c.schedule(cue)
+	}
+	if len(missed) > 0 {
+		c.save()
+	}
+	c.mutex.Unlock()
+
+	sort.Slice(missed, func(i, j int) bool { return missed[i].At < missed[j].At })
+	for _, cue := range missed {
+		if cue.Type == "broadcast" {
+			fmt.Println("dropping missed cue", cue.Id, cue.Type)
+			continue
+		}
+		fmt.Println("firing missed cue", cue.Id, cue.Type)
+		c.Fire(cue)
+	}
+	return nil
+}
+
+func (c *CueList) save() {
+	if c.store == nil {
+		return
+	}
+	values := map[string]interface{}{}
+	for id, cue := range c.cues {
+		values[strconv.FormatUint(uint64(id), 10)] = cue
+	}
+	if err := c.store.Save(values); err != nil {
+		fmt.Println("failed to save cues:", err)
+	}
+}
+
+func (c *CueList) schedule(cue Cue) {
+	if c.cues == nil {
+		c.cues = map[uint32]Cue{}
+		c.timers = map[uint32]*time.Timer{}
+	}
+	c.cues[cue.Id] = cue
+	c.timers[cue.Id] = time.AfterFunc(time.Duration(cue.At-serverTime())*time.Millisecond, func() {
+		c.FireNow(cue.Id)
+	})
+}
+
+func (c *CueList) Add(cue Cue) Cue {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.seq += 1
+	cue.Id = c.seq
+	c.schedule(cue)
+	c.save()
+	return cue
+}
+
+func (c *CueList) take(id uint32) (Cue, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cue, ok := c.cues[id]
+	if !ok {
+		return cue, false
+	}
+	c.timers[id].Stop()
+	delete(c.cues, id)
+	delete(c.timers, id)
+	c.save()
+	return cue, true
+}
+
+func (c *CueList) Cancel(id uint32) bool {
+	_, ok := c.take(id)
+	return ok
+}
+
+// FireNow runs a cue right away instead of when it's scheduled.
+func (c *CueList) FireNow(id uint32) bool {
+	cue, ok := c.take(id)
+	if ok {
+		c.Fire(cue)
+	}
+	return ok
+}
+
+func (c *CueList) List() []Cue {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ret := []Cue{}
+	for _, cue := range c.cues {
+		ret = append(ret, cue)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].At < ret[j].At })
+	return ret
+}
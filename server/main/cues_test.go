@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+type memoryStore map[string]interface{}
+
+func (s memoryStore) Load() (map[string]interface{}, error) { return s, nil }
+
+func (s memoryStore) Save(values map[string]interface{}) error {
+	for k := range s {
+		delete(s, k)
+	}
+	for k, v := range values {
+		s[k] = v
+	}
+	return nil
+}
+
+func TestCuesFireMissedOnce(t *testing.T) {
+	now := serverTime()
+	store := memoryStore{}
+	for _, cue := range []string{
+		fmt.Sprintf(`{"id":1,"at":%d,"type":"setKnob","body":{"name":"a","value":1}}`, now-2000),
+		fmt.Sprintf(`{"id":2,"at":%d,"type":"broadcast","body":{}}`, now-1000),
+		fmt.Sprintf(`{"id":3,"at":%d,"type":"setKnob","body":{"name":"a","value":2}}`, now-500),
+		fmt.Sprintf(`{"id":4,"at":%d,"type":"setKnob","body":{"name":"a","value":3}}`, now+60000),
+	} {
+		var v map[string]interface{}
+		if err := json.Unmarshal([]byte(cue), &v); err != nil {
+			t.Fatal(err)
+		}
+		store[fmt.Sprint(v["id"])] = v
+	}
+	var fired []uint32
+	c := CueList{Fire: func(cue Cue) { fired = append(fired, cue.Id) }}
+	if err := c.Load(store); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Cancel(4)
+	if len(fired) != 2 || fired[0] != 1 || fired[1] != 3 {
+		t.Errorf("fired %v, want [1 3]", fired)
+	}
+	if list := c.List(); len(list) != 1 || list[0].Id != 4 {
+		t.Errorf("still scheduled: %v", list)
+	}
+	if len(store) != 1 {
+		t.Errorf("%d cues saved, want 1", len(store))
+	}
+	if cue := c.Add(Cue{At: now + 60000, Type: "stopPlayback"}); cue.Id != 5 {
+		t.Errorf("new cue got id %d, want 5", cue.Id)
+	} else {
+		c.Cancel(cue.Id)
+	}
+}
@@ -1,23 +1,43 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
+	webrtc "github.com/pion/webrtc/v3"
 	"github.com/s4y/reserve"
+	"github.com/s4y/space/astream"
 	"github.com/s4y/space/knobs"
+	"github.com/s4y/space/util"
 	"github.com/s4y/space/world"
 )
 
-var defaultWorld = world.World{}
+var rooms RoomRegistry
+var audioStream astream.Stream
+var serverAudio *ServerAudio
+
+// Observers that only care about where knobs ended up can skip changes they
+// fell behind on.
+var knobsByName = util.Options[knobs.KnobMessage]{
+	Overflow: util.Coalesce,
+	Key:      func(knob knobs.KnobMessage) interface{} { return knob.Name },
+}
 
 func readConfig(staticDir string) {
 	configFile, err := os.Open(filepath.Join(staticDir, "config.json"))
@@ -29,36 +49,187 @@ func readConfig(staticDir string) {
 	}
 }
 
-var partyLine *WebRTCPartyLine
 var config struct {
-	Knobs            map[string]interface{} `json:"knobs"`
-	SeeAndHear       *bool                  `json:"seeAndHear,omitempty"`
-	Chat             *bool                  `json:"chat,omitempty"`
-	RTCConfiguration json.RawMessage        `json:"rtcConfiguration"`
+	ZeroTime         int64                   `json:"zeroTime"`
+	Knobs            map[string]interface{}  `json:"knobs"`
+	KnobSchema       knobs.Schema            `json:"knobSchema"`
+	SeeAndHear       *bool                   `json:"seeAndHear,omitempty"`
+	Chat             *bool                   `json:"chat,omitempty"`
+	RTCConfiguration json.RawMessage         `json:"rtcConfiguration"`
+	TickRate         float64                 `json:"tickRate"`
+	ResumeGrace      float64                 `json:"resumeGrace"`
+	GuestLimits      world.GuestPublicLimits `json:"guestLimits"`
+	Interest         struct {
+		Radius   float64 `json:"radius"`
+		CellSize float64 `json:"cellSize"`
+	} `json:"interest"`
+	// Guests only get audio and video from guests within these distances
+	// of them, if they're set.
+	Proximity struct {
+		AudioRadius float64 `json:"audioRadius"`
+		VideoRadius float64 `json:"videoRadius"`
+		// Guests farther than this get the cheapest layer of simulcast
+		// video.
+		SimulcastRadius float64 `json:"simulcastRadius"`
+	} `json:"proximity"`
+	OSC OSCConfig `json:"osc"`
 }
 
-var globalKnobs knobs.Knobs = knobs.Knobs{}
-
 type ClockResponse struct {
 	StartTime  float64 `json:"startTime"`
 	ServerTime int64   `json:"serverTime"`
 }
 
-func handleClock(msg json.RawMessage) (ClockResponse, error) {
+func handleClock(msg world.Body) (ClockResponse, error) {
 	var clockMessage struct {
 		StartTime float64 `json:"startTime"`
 	}
-	err := json.Unmarshal(msg, &clockMessage)
+	err := msg.Decode(&clockMessage)
 	if err != nil {
 		return ClockResponse{}, err
 	}
 	return ClockResponse{
 		clockMessage.StartTime,
-		time.Now().UnixNano() / int64(time.Millisecond),
+		serverTime(),
 	}, nil
 }
 
-func startManagementServer(managementAddr string, managementStaticDir string) {
+// runRoomCommand handles the management commands that cues can run, too. who
+// ends up in the knob history.
+func runRoomCommand(room *Room, who string, t string, body world.Body) error {
+	switch t {
+	case "setKnob":
+		var knob knobs.KnobMessage
+		if err := body.Decode(&knob); err != nil {
+			return err
+		}
+		return room.Knobs.SetBy(knob.Name, knob.Value, who)
+	case "recallScene":
+		var sceneMsg struct {
+			Name     string  `json:"name"`
+			Duration float64 `json:"duration"`
+		}
+		if err := body.Decode(&sceneMsg); err != nil {
+			return err
+		}
+		return room.Knobs.RecallScene(sceneMsg.Name, time.Duration(sceneMsg.Duration*float64(time.Second)))
+	case "playTake":
+		var takeMsg struct {
+			Name string `json:"name"`
+			// Server time to start the take at, or milliseconds after
+			// config.json's zeroTime. Right now, if neither is given.
+			At     int64  `json:"at"`
+			Offset *int64 `json:"offset"`
+			Loop   bool   `json:"loop"`
+		}
+		if err := body.Decode(&takeMsg); err != nil {
+			return err
+		}
+		if takeMsg.Offset != nil {
+			takeMsg.At = config.ZeroTime + *takeMsg.Offset
+		} else if takeMsg.At == 0 {
+			takeMsg.At = serverTime()
+		}
+		return room.Knobs.PlayTake(takeMsg.Name, takeMsg.At, takeMsg.Loop)
+	case "stopPlayback":
+		room.Knobs.StopPlayback()
+	case "broadcast":
+		room.World.BroadcastFrom(0, body)
+	default:
+		return errors.New(fmt.Sprint("unknown room command: ", t))
+	}
+	return nil
+}
+
+func makeTakesMessage(room *Room) world.ClientMessage {
+	recording, _ := room.Knobs.Recording()
+	return world.MakeClientMessage("takes", struct {
+		Takes     []knobs.TakeInfo `json:"takes"`
+		Recording string           `json:"recording"`
+	}{room.Knobs.Takes(), recording})
+}
+
+// observeRoom forwards a room's events to a management page. If the page
+// falls behind, only the latest state of each guest and knob is kept.
+func observeRoom(ctx context.Context, room *Room, ch chan interface{}) {
+	byGuest := util.Options[world.GuestEvent]{
+		Overflow: util.Coalesce,
+		Key:      func(e world.GuestEvent) interface{} { return e.Seq },
+	}
+	// Handlers give up once the page is gone, instead of waiting on it
+	// forever.
+	send := func(msg interface{}) {
+		select {
+		case ch <- msg:
+		case <-ctx.Done():
+		}
+	}
+	sendGuest := func(e world.GuestEvent) {
+		// Events come in on separate queues, so don't bring back a guest
+		// who already left.
+		if _, ok := room.World.GetGuests()[e.Seq]; ok {
+			send(world.MakeGuestUpdateMessage(e.Seq, e.Guest))
+		}
+	}
+	room.World.ObserveGuestJoined(ctx, sendGuest, byGuest)
+	room.World.ObserveGuestUpdated(ctx, sendGuest, byGuest)
+	for seq, g := range room.World.GetGuests() {
+		send(world.MakeGuestUpdateMessage(seq, g))
+	}
+	room.World.ObserveGuestDebug(ctx, func(e world.GuestDebug) {
+		send(world.MakeClientMessage(
+			"guestDebug",
+			struct {
+				Id    uint32                 `json:"id"`
+				Debug map[string]interface{} `json:"debug"`
+			}{e.Seq, map[string]interface{}{e.Key: e.Value}}))
+	}, util.Options[world.GuestDebug]{
+		Overflow: util.Coalesce,
+		Key: func(e world.GuestDebug) interface{} {
+			return struct {
+				Seq uint32
+				Key string
+			}{e.Seq, e.Key}
+		},
+	})
+	room.World.ObserveGuestSpeaking(ctx, func(e world.GuestSpeaking) {
+		send(world.MakeClientMessage("guestSpeaking", e))
+	}, util.Options[world.GuestSpeaking]{
+		Overflow: util.Coalesce,
+		Key:      func(e world.GuestSpeaking) interface{} { return e.Seq },
+	})
+	room.World.ObserveGuestLeft(ctx, func(seq uint32) {
+		send(world.MakeClientMessage(
+			"guestLeaving",
+			struct {
+				Id uint32 `json:"id"`
+			}{seq}))
+	})
+	room.Knobs.ObserveChanged(ctx, func(knob knobs.KnobMessage) {
+		send(world.MakeClientMessage("knob", knob))
+	}, knobsByName)
+}
+
+func makeTrackRecordingsMessage(room *Room, recordingsDir string) world.ClientMessage {
+	var msg struct {
+		Recording *RecordingFilter `json:"recording"`
+		Files     []RecordingFile  `json:"files"`
+	}
+	if room.PartyLine != nil {
+		if filter, ok := room.PartyLine.Recording(); ok {
+			msg.Recording = &filter
+		}
+	}
+	if recordingsDir != "" {
+		var err error
+		if msg.Files, err = ListRecordings(recordingsDir); err != nil && !os.IsNotExist(err) {
+			fmt.Println("can't list recordings:", err)
+		}
+	}
+	return world.MakeClientMessage("trackRecordings", msg)
+}
+
+func startManagementServer(managementAddr string, managementStaticDir string, recordingsDir string) {
 	mux := http.NewServeMux()
 	mux.Handle("/", reserve.FileServer(http.Dir(managementStaticDir)))
 
@@ -68,12 +239,20 @@ func startManagementServer(managementAddr string, managementStaticDir string) {
 	upgrader := websocket.Upgrader{}
 
 	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			return
 		}
+		who := "management " + r.RemoteAddr
 		ch := make(chan interface{}, 16)
+		send := func(msg interface{}) {
+			select {
+			case ch <- msg:
+			case <-ctx.Done():
+			}
+		}
 		go func() {
 			for {
 				select {
@@ -84,52 +263,204 @@ func startManagementServer(managementAddr string, managementStaticDir string) {
 				}
 			}
 		}()
-		defaultWorld.Observe(ctx, world.WorldEventGuestJoined, func(seq uint32, g *world.Guest) {
-			ch <- world.MakeGuestUpdateMessage(seq, g)
-		})
-		defaultWorld.Observe(ctx, world.WorldEventGuestUpdated, func(seq uint32, g *world.Guest) {
-			ch <- world.MakeGuestUpdateMessage(seq, g)
-		})
-		for seq, g := range defaultWorld.GetGuests() {
-			ch <- world.MakeGuestUpdateMessage(seq, g)
+		var room *Room
+		var cancelRoom context.CancelFunc
+		selectRoom := func(name string) {
+			if cancelRoom != nil {
+				cancelRoom()
+			}
+			var roomCtx context.Context
+			roomCtx, cancelRoom = context.WithCancel(ctx)
+			room = rooms.Join(roomCtx, name)
+			send(world.MakeClientMessage("room", room.Info()))
+			observeRoom(roomCtx, room, ch)
+			send(world.MakeClientMessage("knobSchema", room.Knobs.Schema()))
+			send(world.MakeClientMessage("scenes", room.Knobs.Scenes()))
+			send(world.MakeClientMessage("cues", room.Cues.List()))
+			send(makeTakesMessage(room))
+			send(world.MakeClientMessage("modulators", room.Knobs.Modulators()))
+			send(makeTrackRecordingsMessage(room, recordingsDir))
 		}
-		defaultWorld.Observe(ctx, world.WorldEventGuestDebug, func(seq uint32, k string, v interface{}) {
-			ch <- world.MakeClientMessage(
-				"guestDebug",
-				struct {
-					Id    uint32                 `json:"id"`
-					Debug map[string]interface{} `json:"debug"`
-				}{seq, map[string]interface{}{k: v}})
+		selectRoom("")
+		audioStream.ObserveSource(ctx, func(e astream.SourceEvent) {
+			send(world.MakeClientMessage("audioSource", e))
 		})
-		defaultWorld.Observe(ctx, world.WorldEventGuestLeft, func(seq uint32) {
-			ch <- world.MakeClientMessage(
-				"guestLeaving",
-				struct {
-					Id uint32 `json:"id"`
-				}{seq})
-		})
-		globalKnobs.Observe(ctx, knobs.KnobChanged, func(name string, value interface{}) {
-			ch <- world.MakeClientMessage(
-				"knob",
-				knobs.KnobMessage{
-					Name:  name,
-					Value: value,
-				})
-		})
-		var msg world.ClientMessage
+		var msg world.IncomingMessage
 		for {
 			if err = conn.ReadJSON(&msg); err != nil {
 				break
 			}
 			switch msg.Type {
-			case "setKnob":
-				var knob knobs.KnobMessage
-				if err := json.Unmarshal(msg.Body, &knob); err != nil {
-					fmt.Println("knob unmarshal err", err)
-				}
-				globalKnobs.Set(knob.Name, knob.Value)
-			case "broadcast":
-				defaultWorld.BroadcastFrom(0, msg.Body)
+			case "setKnob", "recallScene", "playTake", "stopPlayback", "broadcast":
+				if err := runRoomCommand(room, who, msg.Type, msg.Body); err != nil {
+					send(world.MakeClientMessage("error", struct {
+						Message string `json:"message"`
+					}{fmt.Sprint(msg.Type, " failed: ", err)}))
+				}
+			case "saveScene", "deleteScene":
+				var sceneMsg struct {
+					Name string `json:"name"`
+				}
+				if err := msg.Body.Decode(&sceneMsg); err != nil {
+					fmt.Println(err)
+					break
+				}
+				if msg.Type == "saveScene" {
+					room.Knobs.SaveScene(sceneMsg.Name)
+				} else {
+					room.Knobs.DeleteScene(sceneMsg.Name)
+				}
+				send(world.MakeClientMessage("scenes", room.Knobs.Scenes()))
+			case "listScenes":
+				send(world.MakeClientMessage("scenes", room.Knobs.Scenes()))
+			case "addCue":
+				var cueMsg struct {
+					Cue
+					// Milliseconds after config.json's zeroTime, instead
+					// of at.
+					Offset *int64 `json:"offset"`
+				}
+				if err := msg.Body.Decode(&cueMsg); err != nil {
+					fmt.Println(err)
+					break
+				}
+				if cueMsg.Offset != nil {
+					cueMsg.At = config.ZeroTime + *cueMsg.Offset
+				}
+				room.Cues.Add(cueMsg.Cue)
+				send(world.MakeClientMessage("cues", room.Cues.List()))
+			case "cancelCue", "fireCue":
+				var cueMsg struct {
+					Id uint32 `json:"id"`
+				}
+				if err := msg.Body.Decode(&cueMsg); err != nil {
+					fmt.Println(err)
+					break
+				}
+				if msg.Type == "cancelCue" {
+					room.Cues.Cancel(cueMsg.Id)
+				} else {
+					room.Cues.FireNow(cueMsg.Id)
+				}
+				send(world.MakeClientMessage("cues", room.Cues.List()))
+			case "recordTake", "deleteTake":
+				var takeMsg struct {
+					Name string `json:"name"`
+				}
+				if err := msg.Body.Decode(&takeMsg); err != nil {
+					fmt.Println(err)
+					break
+				}
+				if msg.Type == "deleteTake" {
+					room.Knobs.DeleteTake(takeMsg.Name)
+				} else if err := room.Knobs.StartRecording(takeMsg.Name); err != nil {
+					send(world.MakeClientMessage("error", struct {
+						Message string `json:"message"`
+					}{fmt.Sprint("recordTake failed: ", err)}))
+				}
+				send(makeTakesMessage(room))
+			case "stopRecording":
+				room.Knobs.StopRecording()
+				send(makeTakesMessage(room))
+			case "addModulator":
+				var m knobs.Modulator
+				if err := msg.Body.Decode(&m); err != nil {
+					fmt.Println(err)
+					break
+				}
+				if err := room.Knobs.AddModulator(m); err != nil {
+					send(world.MakeClientMessage("error", struct {
+						Message string `json:"message"`
+					}{fmt.Sprint("addModulator failed: ", err)}))
+				}
+				send(world.MakeClientMessage("modulators", room.Knobs.Modulators()))
+			case "removeModulator":
+				var modulatorMsg struct {
+					Knob string `json:"knob"`
+				}
+				if err := msg.Body.Decode(&modulatorMsg); err != nil {
+					fmt.Println(err)
+					break
+				}
+				room.Knobs.RemoveModulator(modulatorMsg.Knob)
+				send(world.MakeClientMessage("modulators", room.Knobs.Modulators()))
+			case "listModulators":
+				send(world.MakeClientMessage("modulators", room.Knobs.Modulators()))
+			case "knobHistory":
+				var historyMsg struct {
+					Name  string `json:"name"`
+					Limit int    `json:"limit"`
+				}
+				if err := msg.Body.Decode(&historyMsg); err != nil {
+					fmt.Println(err)
+					break
+				}
+				send(world.MakeClientMessage("knobHistory", room.Knobs.History(historyMsg.Name, historyMsg.Limit)))
+			case "undoKnobs", "revertKnobs":
+				var undoMsg struct {
+					Count int   `json:"count"`
+					At    int64 `json:"at"`
+				}
+				// Undo the last change unless told otherwise.
+				undoMsg.Count = 1
+				if err := msg.Body.Decode(&undoMsg); err != nil {
+					fmt.Println(err)
+					break
+				}
+				if msg.Type == "undoKnobs" {
+					room.Knobs.Undo(undoMsg.Count)
+				} else {
+					room.Knobs.RevertTo(undoMsg.At)
+				}
+				send(world.MakeClientMessage("knobHistory", room.Knobs.History("", 0)))
+			case "startTrackRecording":
+				var recordMsg struct {
+					RecordingFilter
+					// Seconds between new files.
+					Rotate float64 `json:"rotate"`
+				}
+				if err := msg.Body.Decode(&recordMsg); err != nil {
+					fmt.Println(err)
+					break
+				}
+				if recordingsDir == "" || room.PartyLine == nil {
+					send(world.MakeClientMessage("error", struct {
+						Message string `json:"message"`
+					}{"startTrackRecording failed: recording needs -recordings and a party line"}))
+					break
+				}
+				if err := os.MkdirAll(recordingsDir, 0755); err != nil {
+					fmt.Println("can't make recordings directory:", err)
+					break
+				}
+				prefix := ""
+				if room.Name != "" {
+					prefix = url.PathEscape(room.Name) + "-"
+				}
+				room.PartyLine.StartRecording(recordingsDir, prefix, time.Duration(recordMsg.Rotate*float64(time.Second)), recordMsg.RecordingFilter)
+				send(makeTrackRecordingsMessage(room, recordingsDir))
+			case "stopTrackRecording":
+				if room.PartyLine != nil {
+					room.PartyLine.StopRecording()
+				}
+				send(makeTrackRecordingsMessage(room, recordingsDir))
+			case "listTrackRecordings":
+				send(makeTrackRecordingsMessage(room, recordingsDir))
+			case "listTakes":
+				send(makeTakesMessage(room))
+			case "listCues":
+				send(world.MakeClientMessage("cues", room.Cues.List()))
+			case "listRooms":
+				send(world.MakeClientMessage("rooms", rooms.List()))
+			case "selectRoom":
+				var selectMsg struct {
+					Name string `json:"name"`
+				}
+				if err := msg.Body.Decode(&selectMsg); err != nil {
+					fmt.Println(err)
+					break
+				}
+				selectRoom(selectMsg.Name)
 			case "clock":
 				res, err := handleClock(msg.Body)
 				if err != nil {
@@ -142,15 +473,45 @@ func startManagementServer(managementAddr string, managementStaticDir string) {
 					GuestId uint32 `json:"id"`
 					Kind    string `json:"kind"`
 				}
-				if err := json.Unmarshal(msg.Body, &kickMsg); err != nil {
+				if err := msg.Body.Decode(&kickMsg); err != nil {
 					fmt.Println(err)
 					break
 				}
-				guest, ok := defaultWorld.GetGuests()[kickMsg.GuestId]
+				guest, ok := room.World.GetGuests()[kickMsg.GuestId]
 				if !ok {
 					break
 				}
 				guest.Kick(kickMsg.Kind)
+			case "moderate":
+				var moderateMsg struct {
+					GuestId uint32 `json:"id"`
+					// Whether to turn off the guest's audio or video,
+					// or leave it alone if missing.
+					Audio *bool `json:"audio"`
+					Video *bool `json:"video"`
+					// Seconds until it turns back on, or 0 for never.
+					Duration float64 `json:"duration"`
+				}
+				if err := msg.Body.Decode(&moderateMsg); err != nil {
+					fmt.Println(err)
+					break
+				}
+				if room.PartyLine == nil {
+					break
+				}
+				d := time.Duration(moderateMsg.Duration * float64(time.Second))
+				var err error
+				if moderateMsg.Audio != nil {
+					err = room.PartyLine.Moderate(moderateMsg.GuestId, webrtc.RTPCodecTypeAudio, *moderateMsg.Audio, d)
+				}
+				if moderateMsg.Video != nil && err == nil {
+					err = room.PartyLine.Moderate(moderateMsg.GuestId, webrtc.RTPCodecTypeVideo, *moderateMsg.Video, d)
+				}
+				if err != nil {
+					send(world.MakeClientMessage("error", struct {
+						Message string `json:"message"`
+					}{fmt.Sprint("moderate failed: ", err)}))
+				}
 			default:
 				fmt.Println("unknown message:", msg)
 			}
@@ -160,6 +521,27 @@ func startManagementServer(managementAddr string, managementStaticDir string) {
 	log.Fatal(server.ListenAndServe())
 }
 
+// roomsWithCues returns the rooms that have cues saved in dir by the store in
+// main.
+func roomsWithCues(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "cues*.json"))
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "cues"), ".json")
+		if name == "" {
+			names = append(names, "")
+		} else if strings.HasPrefix(name, ".") {
+			if name, err := url.PathUnescape(name[1:]); err == nil {
+				names = append(names, name)
+			}
+		}
+	}
+	return names, nil
+}
+
 func main() {
 	staticDir := flag.String("static", "../static-default", "Directory for static content")
 	managementStaticDir := flag.String("static-management", "../static-management", "Directory for management static content")
@@ -167,13 +549,71 @@ func main() {
 	production := flag.Bool("p", false, "Production (disables automatic hot reloading)")
 	trustXRealIP := flag.Bool("trust-x-real-ip", false, "Trust the X-Real-IP header, if provided; useful for reverse proxies")
 	managementAddr := flag.String("management", "127.0.0.1:8034", "Listening address for admin pages")
+	knobStateDir := flag.String("knob-state", "", "Directory to save knob values in, so that they survive restarts")
+	audioIngestAddr := flag.String("audio-ingest", "127.0.0.1:8033", "Listening address for an mp3 stream to relay at /astream/, like stream_audio sends")
+	recordingsDir := flag.String("recordings", "", "Directory to record party line tracks to, when asked to from the management page")
+	partyLineAudio := flag.Bool("party-line-audio", false, "Also play the audio ingest to guests over WebRTC (needs a build with -tags opus)")
+	pcmIngestAddr := flag.String("pcm-ingest", "", "Listening address for raw 48kHz, 16-bit stereo audio to play to guests over WebRTC (needs a build with -tags opus)")
+	oscAddr := flag.String("osc", "", "UDP address to listen for OSC knob messages on")
+	oscSendAddr := flag.String("osc-send", "", "UDP address to send knob changes to over OSC")
 	flag.Parse()
 	fmt.Printf("http://%s/\n", *httpAddr)
 
 	readConfig(*staticDir)
-	if config.SeeAndHear != nil && *config.SeeAndHear == false {
-	} else {
-		partyLine = NewWebRTCPartyLine(config.RTCConfiguration)
+	// Saved knobs wait a moment before they're written, so they get
+	// written on the way out instead.
+	var storesMutex sync.Mutex
+	var stores []*knobs.FileStore
+	if *knobStateDir != "" {
+		rooms.Store = func(room string, what string) (knobs.Store, error) {
+			name := what + ".json"
+			if room != "" {
+				name = what + "." + url.PathEscape(room) + ".json"
+			}
+			store, err := knobs.NewFileStore(filepath.Join(*knobStateDir, name), time.Second)
+			if err != nil {
+				return nil, err
+			}
+			storesMutex.Lock()
+			stores = append(stores, store)
+			storesMutex.Unlock()
+			return store, nil
+		}
+	}
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		storesMutex.Lock()
+		for _, store := range stores {
+			if err := store.Flush(); err != nil {
+				fmt.Println("failed to save", store.Path+":", err)
+			}
+		}
+		os.Exit(0)
+	}()
+
+	if *partyLineAudio || *pcmIngestAddr != "" {
+		var err error
+		if serverAudio, err = NewServerAudio(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *partyLineAudio {
+		audioStream.OnSource = func(r io.Reader) {
+			if err := serverAudio.PlayMP3(r); err != nil {
+				fmt.Println("can't play audio ingest:", err)
+			}
+		}
+	}
+
+	if *knobStateDir != "" {
+		// Rooms with saved cues need to be around for them to fire.
+		names, err := roomsWithCues(*knobStateDir)
+		if err != nil {
+			fmt.Println("can't list saved cues:", err)
+		}
+		rooms.Preload(names)
 	}
 
 	ln, err := net.Listen("tcp", *httpAddr)
@@ -181,13 +621,9 @@ func main() {
 		log.Fatal(err)
 	}
 
-	for name, value := range config.Knobs {
-		globalKnobs.Set(name, value)
-	}
-
-	upgrader := websocket.Upgrader{}
+	upgrader := websocket.Upgrader{Subprotocols: world.Subprotocols()}
 
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+	handleGuest := func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
@@ -212,22 +648,26 @@ func main() {
 				guest.DebugInfo.Store("ip_names", names)
 			})()
 		}
-		var msg world.ClientMessage
+		var msg world.IncomingMessage
 		var seq uint32
-
-		globalKnobs.Observe(ctx, knobs.KnobChanged, func(name string, value interface{}) {
-			guest.Write(world.MakeClientMessage("knob", knobs.KnobMessage{
-				Name:  name,
-				Value: value,
-			}))
-		})
+		var room *Room
+		roomName := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/ws"), "/")
 
 		rtcPeer := WebRTCPartyLinePeer{
 			SendToPeer: func(message interface{}) {
+				// Signaling types only know how to be JSON, so CBOR
+				// guests get what that decodes to.
+				data, err := json.Marshal(message)
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				var decoded interface{}
+				json.Unmarshal(data, &decoded)
 				guest.Write(world.MakeClientMessage("rtc", struct {
 					From    uint32      `json:"from"`
 					Message interface{} `json:"message"`
-				}{0, message}))
+				}{0, decoded}))
 			},
 			MapTrack: func(mid string, id uint32) {
 				guest.Write(world.MakeClientMessage("mapTrack", struct {
@@ -238,31 +678,70 @@ func main() {
 			MaxBandwidth: 500000,
 		}
 
+		rejectedStates := 0
+		rejectState := func(err error) {
+			rejectedStates += 1
+			guest.Write(world.MakeClientMessage("error", struct {
+				Message string `json:"message"`
+			}{fmt.Sprint("rejected state: ", err)}))
+			if seq == 0 {
+				guest.DebugInfo.Store("rejectedStates", rejectedStates)
+				guest.DebugInfo.Store("lastRejectedState", err.Error())
+				return
+			}
+			room.World.SetGuestDebug(seq, "rejectedStates", rejectedStates)
+			room.World.SetGuestDebug(seq, "lastRejectedState", err.Error())
+		}
+
 		for {
-			if err = conn.ReadJSON(&msg); err != nil {
+			if err = guest.ReadMessage(&msg); err != nil {
 				break
 			}
 			switch msg.Type {
 			case "join":
 				if seq != 0 {
-					defaultWorld.Rejoin(seq)
+					room.World.Rejoin(seq)
 				} else {
-					var state world.GuestPublic
-					err := json.Unmarshal(msg.Body, &state)
+					var joinOptions struct {
+						ResumeToken string `json:"resumeToken"`
+					}
+					msg.Body.Decode(&joinOptions)
+					state, err := config.GuestLimits.Parse(msg.Body, "resumeToken")
 					if err != nil {
-						fmt.Println(err)
-						return
+						rejectState(err)
+						break
 					}
 					guest.Public = state
 					if state["role"] == "cast" {
 						rtcPeer.MaxBandwidth = 5000000
 					}
-					seq = defaultWorld.AddGuest(ctx, guest)
+					rtcPeer.Role, _ = state["role"].(string)
+					if name, ok := state["room"].(string); ok {
+						roomName = name
+					}
+					room = rooms.Join(ctx, roomName)
+					room.Knobs.ObserveChanged(ctx, func(knob knobs.KnobMessage) {
+						guest.Write(world.MakeClientMessage("knob", knob))
+					}, knobsByName)
+					if joinOptions.ResumeToken != "" {
+						var resumed bool
+						if seq, resumed = room.World.Resume(ctx, joinOptions.ResumeToken, guest); resumed {
+							room.World.UpdateGuest(seq, state)
+						}
+					}
+					if seq == 0 {
+						seq = room.World.AddGuest(ctx, guest)
+					}
 					rtcPeer.UserInfo = seq
-					defaultWorld.UpdateGuest(seq)
+					rtcPeer.SetDebug = func(key string, value interface{}) {
+						room.World.SetGuestDebug(seq, key, value)
+					}
+					rtcPeer.OnSpeaking = func(speaking bool) {
+						room.World.SetSpeaking(seq, speaking)
+					}
 
-					if partyLine != nil {
-						if err := partyLine.AddPeer(ctx, &rtcPeer); err != nil {
+					if room.PartyLine != nil {
+						if err := room.PartyLine.AddPeer(ctx, &rtcPeer); err != nil {
 							fmt.Println("err creating peerconnection ", seq, err)
 							return
 						}
@@ -273,52 +752,63 @@ func main() {
 					fmt.Println("client tried to send state without joining first ", conn.RemoteAddr().String())
 					break
 				}
-				var state world.GuestPublic
-				err := json.Unmarshal(msg.Body, &state)
+				state, err := config.GuestLimits.Parse(msg.Body)
 				if err != nil {
-					fmt.Println(err)
+					rejectState(err)
 					break
 				}
-				guest.Public = state
-				defaultWorld.UpdateGuest(seq)
+				room.World.UpdateGuest(seq, state)
 			case "debug.fps":
+				if seq == 0 {
+					break
+				}
 				var fps float64
-				if err := json.Unmarshal(msg.Body, &fps); err != nil {
+				if err := msg.Body.Decode(&fps); err != nil {
 					fmt.Println("bad fps value from ", seq)
 				}
-				defaultWorld.SetGuestDebug(seq, "fps", fps)
+				room.World.SetGuestDebug(seq, "fps", fps)
 			case "getKnobs":
-				for name, value := range globalKnobs.Get() {
+				// Guests that haven't joined yet get every knob once they do.
+				if room == nil {
+					break
+				}
+				for name, value := range room.Knobs.Get() {
 					guest.Write(world.MakeClientMessage("knob", knobs.KnobMessage{
 						Name:  name,
 						Value: value,
 					}))
 				}
 			case "rtc":
-				if partyLine == nil {
+				if room == nil || room.PartyLine == nil {
 					break
 				}
 				var messageIn struct {
-					To      uint32          `json:"to"`
-					Message json.RawMessage `json:"message"`
+					To      uint32     `json:"to"`
+					Message world.Body `json:"message"`
 				}
-				err := json.Unmarshal(msg.Body, &messageIn)
+				err := msg.Body.Decode(&messageIn)
 				if err != nil {
 					fmt.Println(err)
 					break
 				}
-				if err := rtcPeer.HandleMessage(messageIn.Message); err != nil {
-					fmt.Println("malformed rtc message from", seq, string(messageIn.Message), err)
+				// Signaling is JSON no matter how it got here.
+				rtcMessage, err := json.Marshal(messageIn.Message)
+				if err != nil {
+					fmt.Println(err)
+					break
+				}
+				if err := rtcPeer.HandleMessage(rtcMessage); err != nil {
+					fmt.Println("malformed rtc message from", seq, string(rtcMessage), err)
 				}
 			case "chat":
-				if config.Chat != nil && *config.Chat == false {
+				if seq == 0 || config.Chat != nil && *config.Chat == false {
 					break
 				}
 				var chatMessage struct {
 					Message string `json:"message"`
 				}
 
-				err := json.Unmarshal(msg.Body, &chatMessage)
+				err := msg.Body.Decode(&chatMessage)
 				if err != nil {
 					fmt.Println(err)
 					break
@@ -329,7 +819,7 @@ func main() {
 					Message interface{} `json:"message"`
 				}{seq, chatMessage.Message})
 
-				defaultWorld.BroadcastFrom(seq, outboundMessage)
+				room.World.BroadcastFrom(seq, outboundMessage)
 			case "clock":
 				res, err := handleClock(msg.Body)
 				if err != nil {
@@ -342,8 +832,10 @@ func main() {
 			}
 		}
 		return
-	})
-	// http.Handle("/astream/", http.FileServer(http.Dir(".")))
+	}
+	http.HandleFunc("/ws", handleGuest)
+	http.HandleFunc("/ws/", handleGuest)
+	http.Handle("/astream/", &audioStream)
 	if *production {
 		fileServer := http.FileServer(http.Dir(*staticDir))
 		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -355,6 +847,19 @@ func main() {
 		http.Handle("/", reserve.FileServer(http.Dir(*staticDir)))
 	}
 
-	go startManagementServer(*managementAddr, *managementStaticDir)
+	go startManagementServer(*managementAddr, *managementStaticDir, *recordingsDir)
+	if *oscAddr != "" || *oscSendAddr != "" {
+		go startOSC(*oscAddr, *oscSendAddr)
+	}
+	if *pcmIngestAddr != "" {
+		go func() {
+			fmt.Println("PCM ingest failed:", serverAudio.ListenAndPlayPCM(*pcmIngestAddr))
+		}()
+	}
+	if *audioIngestAddr != "" {
+		go func() {
+			fmt.Println("audio ingest failed:", audioStream.ListenAndIngest(*audioIngestAddr))
+		}()
+	}
 	log.Fatal(http.Serve(ln, nil))
 }
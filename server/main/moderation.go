@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pion/rtcp"
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+// A Moderation says which of a guest's tracks moderators have turned off.
+type Moderation struct {
+	AudioMuted bool `json:"audioMuted"`
+	VideoOff   bool `json:"videoOff"`
+	// When timed mutes end, in milliseconds since the epoch.
+	AudioUntil int64 `json:"audioUntil,omitempty"`
+	VideoUntil int64 `json:"videoUntil,omitempty"`
+}
+
+type moderationKey struct {
+	id   uint32
+	kind webrtc.RTPCodecType
+}
+
+// A moderatedTrack is a kind of track a guest isn't allowed to send.
+type moderatedTrack struct {
+	until time.Time
+	timer *time.Timer
+}
+
+// Moderate stops forwarding id's tracks of kind to other peers, or lets them
+// through again. If d is nonzero, it undoes itself after d. Ids get reused,
+// so it's an error to moderate a guest who isn't here.
+func (pl *WebRTCPartyLine) Moderate(id uint32, kind webrtc.RTPCodecType, off bool, d time.Duration) error {
+	if !pl.hasPeer(id) {
+		return errors.New(fmt.Sprint("no such guest: ", id))
+	}
+	pl.moderationMutex.Lock()
+	defer pl.moderationMutex.Unlock()
+	key := moderationKey{id, kind}
+	if mt, ok := pl.moderation[key]; ok && mt.timer != nil {
+		mt.timer.Stop()
+	}
+	if off {
+		mt := &moderatedTrack{}
+		if d > 0 {
+			mt.until = time.Now().Add(d)
+			mt.timer = time.AfterFunc(d, func() {
+				pl.moderationMutex.Lock()
+				defer pl.moderationMutex.Unlock()
+				// Someone may have changed it since.
+				if pl.moderation[key] != mt {
+					return
+				}
+				pl.setModeration(key, nil)
+				pl.lifted(key)
+				pl.notifyModerated(id)
+			})
+		}
+		pl.setModeration(key, mt)
+	} else if !pl.setModeration(key, nil) {
+		return nil
+	} else {
+		pl.lifted(key)
+	}
+	pl.notifyModerated(id)
+	return nil
+}
+
+// lifted is called once a guest's tracks of a kind go through again.
+// Subscribers can't show video until its next keyframe, so it asks for one
+// instead of waiting for the next regular PLI.
+func (pl *WebRTCPartyLine) lifted(key moderationKey) {
+	if key.kind != webrtc.RTPCodecTypeVideo {
+		return
+	}
+	peers, _ := pl.peers.Load().([]*WebRTCPartyLinePeer)
+	for _, p := range peers {
+		if p.UserInfo != key.id || p.peerConnection == nil {
+			continue
+		}
+		var packets []rtcp.Packet
+		for _, receiver := range p.peerConnection.GetReceivers() {
+			for _, track := range receiver.Tracks() {
+				if track.Kind() == webrtc.RTPCodecTypeVideo && track.SSRC() != 0 {
+					packets = append(packets, &rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())})
+				}
+			}
+		}
+		if len(packets) == 0 {
+			continue
+		}
+		if err := p.peerConnection.WriteRTCP(packets); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+func (pl *WebRTCPartyLine) hasPeer(id uint32) bool {
+	peers, _ := pl.peers.Load().([]*WebRTCPartyLinePeer)
+	for _, p := range peers {
+		if p.UserInfo == id {
+			return true
+		}
+	}
+	return false
+}
+
+// setModeration must be called with moderationMutex held. It returns
+// whether anything changed.
+func (pl *WebRTCPartyLine) setModeration(key moderationKey, mt *moderatedTrack) bool {
+	_, wasOff := pl.moderation[key]
+	if mt == nil && !wasOff {
+		return false
+	}
+	moderation := make(map[moderationKey]*moderatedTrack, len(pl.moderation)+1)
+	for k, v := range pl.moderation {
+		moderation[k] = v
+	}
+	if mt != nil {
+		moderation[key] = mt
+	} else {
+		delete(moderation, key)
+	}
+	pl.moderation = moderation
+	pl.moderated.Store(moderation)
+	return true
+}
+
+func (pl *WebRTCPartyLine) notifyModerated(id uint32) {
+	if pl.OnModerated != nil {
+		pl.OnModerated(id, pl.moderationOf(id))
+	}
+}
+
+func (pl *WebRTCPartyLine) moderationOf(id uint32) Moderation {
+	var m Moderation
+	if mt, ok := pl.moderation[moderationKey{id, webrtc.RTPCodecTypeAudio}]; ok {
+		m.AudioMuted = true
+		if mt.timer != nil {
+			m.AudioUntil = mt.until.UnixMilli()
+		}
+	}
+	if mt, ok := pl.moderation[moderationKey{id, webrtc.RTPCodecTypeVideo}]; ok {
+		m.VideoOff = true
+		if mt.timer != nil {
+			m.VideoUntil = mt.until.UnixMilli()
+		}
+	}
+	return m
+}
+
+// Moderation returns what moderators have turned off for id.
+func (pl *WebRTCPartyLine) Moderation(id uint32) Moderation {
+	pl.moderationMutex.Lock()
+	defer pl.moderationMutex.Unlock()
+	return pl.moderationOf(id)
+}
+
+// ForgetModeration drops id's moderation, without telling anyone, once the
+// guest is gone for good.
+func (pl *WebRTCPartyLine) ForgetModeration(id uint32) {
+	pl.moderationMutex.Lock()
+	defer pl.moderationMutex.Unlock()
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		key := moderationKey{id, kind}
+		if mt, ok := pl.moderation[key]; ok && mt.timer != nil {
+			mt.timer.Stop()
+		}
+		pl.setModeration(key, nil)
+	}
+}
+
+// isModerated is cheap enough to call for every packet.
+func (pl *WebRTCPartyLine) isModerated(id uint32, kind webrtc.RTPCodecType) bool {
+	moderation, _ := pl.moderated.Load().(map[moderationKey]*moderatedTrack)
+	_, ok := moderation[moderationKey{id, kind}]
+	return ok
+}
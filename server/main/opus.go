@@ -0,0 +1,9 @@
+//go:build opus
+
+package main
+
+import "gopkg.in/hraban/opus.v2"
+
+func newOpusEncoder() (opusEncoder, error) {
+	return opus.NewEncoder(opusSampleRate, opusChannels, opus.AppAudio)
+}
@@ -0,0 +1,11 @@
+//go:build !opus
+
+package main
+
+import "errors"
+
+// Encoding Opus needs cgo and libopus, so builds that play server audio to
+// guests opt in with -tags opus.
+func newOpusEncoder() (opusEncoder, error) {
+	return nil, errors.New("playing server audio to guests needs a build with -tags opus")
+}
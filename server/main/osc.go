@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/s4y/space/knobs"
+	"github.com/s4y/space/osc"
+)
+
+// OSCMapping ties an OSC address to a knob. If Min and Max are set, OSC
+// values from 0 to 1 are scaled to the range Min to Max, and back.
+type OSCMapping struct {
+	Address string  `json:"address"`
+	Knob    string  `json:"knob"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+}
+
+func (m OSCMapping) toKnob(v float64) float64 {
+	if m.Min == m.Max {
+		return v
+	}
+	return m.Min + v*(m.Max-m.Min)
+}
+
+func (m OSCMapping) fromKnob(v float64) float64 {
+	if m.Min == m.Max {
+		return v
+	}
+	return (v - m.Min) / (m.Max - m.Min)
+}
+
+type OSCConfig struct {
+	Room     string       `json:"room"`
+	Mappings []OSCMapping `json:"mappings"`
+}
+
+func oscFloat(arg interface{}) (float64, bool) {
+	switch arg := arg.(type) {
+	case float32:
+		return float64(arg), true
+	case float64:
+		return arg, true
+	case int32:
+		return float64(arg), true
+	case int64:
+		return float64(arg), true
+	}
+	return 0, false
+}
+
+// startOSC sets knobs in the configured room from OSC messages sent to
+// listenAddr, and sends every knob change to sendAddr. Addresses that aren't
+// mapped are treated as /knob/<name>. Either address can be empty.
+func startOSC(listenAddr, sendAddr string) {
+	room := rooms.Join(context.Background(), config.OSC.Room)
+	byAddress := map[string]OSCMapping{}
+	byKnob := map[string]OSCMapping{}
+	for _, m := range config.OSC.Mappings {
+		byAddress[m.Address] = m
+		byKnob[m.Knob] = m
+	}
+
+	if sendAddr != "" {
+		conn, err := net.Dial("udp", sendAddr)
+		if err != nil {
+			fmt.Println("can't send OSC:", err)
+		} else {
+			fmt.Printf("Sending knobs over OSC to %s\n", sendAddr)
+			room.Knobs.ObserveChanged(context.Background(), func(knob knobs.KnobMessage) {
+				m, ok := byKnob[knob.Name]
+				if !ok {
+					m = OSCMapping{Address: "/knob/" + knob.Name}
+				}
+				value := knob.Value
+				if f, ok := value.(float64); ok {
+					value = float32(m.fromKnob(f))
+				}
+				data, err := osc.Message{Address: m.Address, Args: []interface{}{value}}.Marshal()
+				if err != nil {
+					fmt.Println("can't send knob over OSC:", knob.Name, err)
+					return
+				}
+				conn.Write(data)
+			})
+		}
+	}
+
+	if listenAddr == "" {
+		return
+	}
+	pc, err := net.ListenPacket("udp", listenAddr)
+	if err != nil {
+		fmt.Println("can't listen for OSC:", err)
+		return
+	}
+	fmt.Printf("Listening for OSC on %s\n", listenAddr)
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			fmt.Println("OSC read error:", err)
+			return
+		}
+		msgs, err := osc.Parse(buf[:n])
+		if err != nil {
+			fmt.Println("bad OSC packet:", err)
+			continue
+		}
+		for _, msg := range msgs {
+			m, ok := byAddress[msg.Address]
+			if !ok {
+				if !strings.HasPrefix(msg.Address, "/knob/") {
+					continue
+				}
+				m = OSCMapping{Knob: strings.TrimPrefix(msg.Address, "/knob/")}
+			}
+			if len(msg.Args) != 1 {
+				fmt.Println("OSC message for knob", m.Knob, "should have one argument")
+				continue
+			}
+			var value interface{} = msg.Args[0]
+			if f, ok := oscFloat(value); ok {
+				value = m.toKnob(f)
+			}
+			if err := room.Knobs.SetBy(m.Knob, value, "osc "+addr.String()); err != nil {
+				fmt.Println("OSC can't set knob", m.Knob, err)
+			}
+		}
+	}
+}
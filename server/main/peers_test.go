@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+// connectPeers connects a pair of local PeerConnections, one sending tracks
+// and the other putting every RTP packet it gets on packets.
+func connectPeers(t *testing.T, tracks []webrtc.TrackLocal, packets chan<- *rtp.Packet) (send, recv *webrtc.PeerConnection) {
+	send, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv, err = webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, track := range tracks {
+		if _, err := send.AddTrack(track); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recv.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		for {
+			packet, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			select {
+			case packets <- packet:
+			default:
+			}
+		}
+	})
+	connected := make(chan bool)
+	send.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+
+	offer, err := send.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(send)
+	if err := send.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := recv.SetRemoteDescription(*send.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := recv.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered = webrtc.GatheringCompletePromise(recv)
+	if err := recv.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := send.SetRemoteDescription(*recv.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("peers never connected")
+	}
+	// DTLS finishes on both sides a little after the sender says it's
+	// connected, and packets sent before then go nowhere.
+	time.Sleep(100 * time.Millisecond)
+	return send, recv
+}
+
+// receive waits for n packets.
+func receive(t *testing.T, packets <-chan *rtp.Packet, n int) []*rtp.Packet {
+	var got []*rtp.Packet
+	timeout := time.After(2 * time.Second)
+	for len(got) < n {
+		select {
+		case packet := <-packets:
+			got = append(got, packet)
+		case <-timeout:
+			t.Fatalf("got %d RTP packets, want %d", len(got), n)
+		}
+	}
+	return got
+}
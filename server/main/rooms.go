@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/s4y/space/knobs"
+	"github.com/s4y/space/util"
+	"github.com/s4y/space/world"
+)
+
+const (
+	// Guest updates are sent this many times per second unless config.json
+	// says otherwise. A negative tickRate sends them immediately.
+	defaultTickRate = 20
+	// Seconds that guests can take to reconnect without everyone seeing
+	// them leave. A negative resumeGrace turns this off.
+	defaultResumeGrace = 10
+)
+
+type Room struct {
+	Name      string
+	World     world.World
+	Knobs     knobs.Knobs
+	Cues      CueList
+	PartyLine *WebRTCPartyLine
+
+	refs   int
+	cancel context.CancelFunc
+}
+
+type RoomInfo struct {
+	Name   string `json:"name"`
+	Guests int    `json:"guests"`
+	// Events that observers of the room missed because they fell behind.
+	DroppedEvents uint64 `json:"droppedEvents"`
+}
+
+func (room *Room) Info() RoomInfo {
+	return RoomInfo{room.Name, len(room.World.GetGuests()), room.World.DroppedEvents() + room.Knobs.DroppedEvents()}
+}
+
+// RoomRegistry creates rooms on demand and tears them down once nothing
+// holds a reference to them anymore.
+type RoomRegistry struct {
+	// If set, each room's knobs, scenes, takes, modulators and cues are
+	// saved to and restored from the stores this returns. what is "knobs",
+	// "scenes", "takes", "modulators" or "cues".
+	Store func(room string, what string) (knobs.Store, error)
+
+	mutex sync.Mutex
+	rooms map[string]*Room
+}
+
+func (r *RoomRegistry) newRoom(name string) *Room {
+	room := &Room{Name: name}
+	room.World.InterestRadius = config.Interest.Radius
+	room.World.InterestCellSize = config.Interest.CellSize
+	tickRate := config.TickRate
+	if tickRate == 0 {
+		tickRate = defaultTickRate
+	}
+	if tickRate > 0 {
+		room.World.TickInterval = time.Duration(float64(time.Second) / tickRate)
+	}
+	resumeGrace := config.ResumeGrace
+	if resumeGrace == 0 {
+		resumeGrace = defaultResumeGrace
+	}
+	if resumeGrace > 0 {
+		room.World.ResumeGrace = time.Duration(resumeGrace * float64(time.Second))
+	}
+	room.Knobs.SetSchema(config.KnobSchema)
+	for name, value := range config.Knobs {
+		if err := room.Knobs.Set(name, value); err != nil {
+			fmt.Println("bad knob in config.json:", err)
+		}
+	}
+	room.Cues.Fire = func(cue Cue) {
+		if err := runRoomCommand(room, fmt.Sprint("cue ", cue.Id), cue.Type, cue.Body); err != nil {
+			fmt.Println("cue", cue.Id, "failed:", err)
+		}
+		go r.collect(room)
+	}
+	if r.Store != nil {
+		for _, what := range []struct {
+			name string
+			load func(knobs.Store) error
+		}{
+			{"knobs", room.Knobs.SetStore},
+			{"scenes", room.Knobs.SetSceneStore},
+			{"takes", room.Knobs.SetTakeStore},
+			{"modulators", room.Knobs.SetModulatorStore},
+			{"cues", room.Cues.Load},
+		} {
+			store, err := r.Store(name, what.name)
+			if err == nil {
+				err = what.load(store)
+			}
+			if err != nil {
+				fmt.Println("failed to load", what.name, "for room", name, err)
+			}
+		}
+	}
+	if config.SeeAndHear != nil && *config.SeeAndHear == false {
+	} else {
+		room.PartyLine = NewWebRTCPartyLine(config.RTCConfiguration)
+		room.PartyLine.AudioRadius = config.Proximity.AudioRadius
+		room.PartyLine.VideoRadius = config.Proximity.VideoRadius
+		room.PartyLine.SimulcastRadius = config.Proximity.SimulcastRadius
+		room.PartyLine.Distance = room.World.Distance
+		room.PartyLine.OnModerated = func(id uint32, m Moderation) {
+			guest, ok := room.World.GetGuests()[id]
+			if !ok {
+				return
+			}
+			guest.Write(world.MakeClientMessage("moderated", m))
+			room.World.SetGuestDebug(id, "moderation", m)
+		}
+		if serverAudio != nil {
+			room.PartyLine.AddServerTrack(serverAudio.Track, serverTrackId)
+		}
+	}
+	return room
+}
+
+// Join returns the named room, creating it if needed. The room stays alive at
+// least until ctx is done.
+func (r *RoomRegistry) Join(ctx context.Context, name string) *Room {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	room := r.get(name)
+	room.refs += 1
+	go func() {
+		<-ctx.Done()
+		r.release(room)
+	}()
+	return room
+}
+
+// Preload creates the named rooms, so that cues saved in them fire even if
+// nobody joins. Rooms with nothing scheduled go away again.
+func (r *RoomRegistry) Preload(names []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, name := range names {
+		go r.collect(r.get(name))
+	}
+}
+
+// get must be called with mutex held.
+func (r *RoomRegistry) get(name string) *Room {
+	if r.rooms == nil {
+		r.rooms = map[string]*Room{}
+	}
+	room, ok := r.rooms[name]
+	if !ok {
+		room = r.newRoom(name)
+		r.rooms[name] = room
+		var roomCtx context.Context
+		roomCtx, room.cancel = context.WithCancel(context.Background())
+		go room.World.Run(roomCtx)
+		// Guests who might still resume keep the room around after
+		// their connection closes.
+		room.World.ObserveGuestLeft(roomCtx, func(uint32) {
+			go r.collect(room)
+		})
+		if room.PartyLine != nil {
+			room.World.ObserveGuestLeft(roomCtx, func(seq uint32) {
+				room.PartyLine.ForgetModeration(seq)
+			})
+			room.World.ObserveGuestUpdated(roomCtx, func(e world.GuestEvent) {
+				room.PartyLine.Moved(e.Seq)
+			}, util.Options[world.GuestEvent]{
+				Overflow: util.Coalesce,
+				Key:      func(e world.GuestEvent) interface{} { return e.Seq },
+			})
+		}
+	}
+	return room
+}
+
+func (r *RoomRegistry) release(room *Room) {
+	r.mutex.Lock()
+	room.refs -= 1
+	r.mutex.Unlock()
+	r.collect(room)
+}
+
+func (r *RoomRegistry) collect(room *Room) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, recording := room.Knobs.Recording(); recording {
+		return
+	}
+	if room.refs == 0 && r.rooms[room.Name] == room && len(room.World.GetGuests()) == 0 && len(room.Cues.List()) == 0 {
+		delete(r.rooms, room.Name)
+		room.Knobs.Stop()
+		// This stops the room's observers, too.
+		room.cancel()
+		if room.PartyLine != nil {
+			room.PartyLine.Close()
+		}
+	}
+}
+
+func (r *RoomRegistry) List() []RoomInfo {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	ret := []RoomInfo{}
+	for _, room := range r.rooms {
+		ret = append(ret, room.Info())
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hajimehoshi/go-mp3"
+	webrtc "github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const (
+	// Clients see server audio as a track from guest 0, the same id that
+	// server broadcasts come from.
+	serverTrackId = 0
+
+	opusSampleRate = 48000
+	opusChannels   = 2
+	opusFrameTime  = 20 * time.Millisecond
+	opusFrameSize  = opusSampleRate * int(opusFrameTime) / int(time.Second)
+)
+
+type opusEncoder interface {
+	Encode(pcm []int16, data []byte) (int, error)
+}
+
+// ServerAudio sends audio that the server itself plays, like the DJ's set,
+// to everyone in every party line as one Opus track.
+type ServerAudio struct {
+	Track *webrtc.TrackLocalStaticSample
+
+	// One source plays at a time.
+	mutex sync.Mutex
+
+	newEncoder func() (opusEncoder, error)
+}
+
+func NewServerAudio() (*ServerAudio, error) {
+	// Fail at startup, not when the first source connects.
+	if _, err := newOpusEncoder(); err != nil {
+		return nil, err
+	}
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+		MimeType:  webrtc.MimeTypeOpus,
+		ClockRate: opusSampleRate,
+		Channels:  opusChannels,
+	}, "server-audio", "server")
+	if err != nil {
+		return nil, err
+	}
+	return &ServerAudio{Track: track, newEncoder: newOpusEncoder}, nil
+}
+
+// resampler converts stereo audio between sample rates by linear
+// interpolation, which is plenty for 44.1kHz mp3s.
+type resampler struct {
+	step float64
+	pos  float64
+	prev [2]float64
+}
+
+func (rs *resampler) push(frame [2]float64, out func([2]float64)) {
+	for ; rs.pos < 1; rs.pos += rs.step {
+		out([2]float64{
+			rs.prev[0] + (frame[0]-rs.prev[0])*rs.pos,
+			rs.prev[1] + (frame[1]-rs.prev[1])*rs.pos,
+		})
+	}
+	rs.pos -= 1
+	rs.prev = frame
+}
+
+// PlayPCM plays interleaved, little-endian, 16-bit stereo audio at
+// sampleRate until pcm ends.
+func (a *ServerAudio) PlayPCM(pcm io.Reader, sampleRate int) error {
+	if sampleRate <= 0 {
+		return errors.New(fmt.Sprint("bad sample rate: ", sampleRate))
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	encoder, err := a.newEncoder()
+	if err != nil {
+		return err
+	}
+
+	rs := resampler{step: float64(sampleRate) / opusSampleRate}
+	frame := make([]int16, 0, opusFrameSize*opusChannels)
+	packet := make([]byte, 4000)
+	// Sources that send faster than real time, like files, get slowed
+	// down. Live ones that fall behind just pick up where they are.
+	start := time.Now()
+	var sent time.Duration
+	emit := func(sample [2]float64) error {
+		frame = append(frame, int16(sample[0]), int16(sample[1]))
+		if len(frame) < cap(frame) {
+			return nil
+		}
+		n, err := encoder.Encode(frame, packet)
+		frame = frame[:0]
+		if err != nil {
+			return err
+		}
+		if err := a.Track.WriteSample(media.Sample{Data: packet[:n], Duration: opusFrameTime}); err != nil {
+			return err
+		}
+		sent += opusFrameTime
+		if ahead := sent - time.Since(start); ahead > 0 {
+			time.Sleep(ahead)
+		} else if ahead < -time.Second {
+			start = time.Now().Add(-sent)
+		}
+		return nil
+	}
+
+	buf := make([]byte, 4096)
+	have := 0
+	for {
+		n, readErr := pcm.Read(buf[have:])
+		have += n
+		i := 0
+		for ; i+4 <= have; i += 4 {
+			l := int16(uint16(buf[i]) | uint16(buf[i+1])<<8)
+			r := int16(uint16(buf[i+2]) | uint16(buf[i+3])<<8)
+			var err error
+			rs.push([2]float64{float64(l), float64(r)}, func(sample [2]float64) {
+				if err == nil {
+					err = emit(sample)
+				}
+			})
+			if err != nil {
+				return err
+			}
+		}
+		have = copy(buf, buf[i:have])
+		if readErr == io.EOF {
+			return nil
+		} else if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// PlayMP3 decodes an mp3 stream and plays it until it ends.
+func (a *ServerAudio) PlayMP3(r io.Reader) error {
+	decoder, err := mp3.NewDecoder(r)
+	if err != nil {
+		return err
+	}
+	return a.PlayPCM(decoder, decoder.SampleRate())
+}
+
+// ListenAndPlayPCM plays raw audio, 48kHz and otherwise like PlayPCM wants
+// it, from anyone who connects to addr.
+func (a *ServerAudio) ListenAndPlayPCM(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := a.PlayPCM(conn, opusSampleRate); err != nil {
+				fmt.Println("PCM source failed:", err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+// fakeEncoder stands in for libopus in builds without -tags opus.
+type fakeEncoder struct{}
+
+func (fakeEncoder) Encode(pcm []int16, data []byte) (int, error) {
+	return copy(data, []byte{0xf8, 0xff, 0xfe}), nil
+}
+
+func tone(sampleRate int, d time.Duration) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < sampleRate*int(d)/int(time.Second); i++ {
+		v := int16(math.Sin(2*math.Pi*440*float64(i)/float64(sampleRate)) * 10000)
+		binary.Write(&buf, binary.LittleEndian, [2]int16{v, v})
+	}
+	return buf.Bytes()
+}
+
+func TestServerAudioSendsRTP(t *testing.T) {
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+		MimeType:  webrtc.MimeTypeOpus,
+		ClockRate: opusSampleRate,
+		Channels:  opusChannels,
+	}, "server-audio", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio := &ServerAudio{Track: track, newEncoder: newOpusEncoder}
+	if _, err := newOpusEncoder(); err != nil {
+		audio.newEncoder = func() (opusEncoder, error) { return fakeEncoder{}, nil }
+	}
+
+	packets := make(chan *rtp.Packet, 100)
+	send, recv := connectPeers(t, []webrtc.TrackLocal{track}, packets)
+	defer send.Close()
+	defer recv.Close()
+
+	// A 44.1kHz tone, which gets resampled on the way in.
+	if err := audio.PlayPCM(bytes.NewReader(tone(44100, 500*time.Millisecond)), 44100); err != nil {
+		t.Fatal(err)
+	}
+
+	got := receive(t, packets, 10)
+	for i := 1; i < len(got); i++ {
+		if got[i].SequenceNumber != got[i-1].SequenceNumber+1 {
+			t.Errorf("packet %d has sequence number %d after %d", i, got[i].SequenceNumber, got[i-1].SequenceNumber)
+		}
+		if step := got[i].Timestamp - got[i-1].Timestamp; step != uint32(opusFrameSize) {
+			t.Errorf("packet %d timestamp moved by %d, want %d", i, step, opusFrameSize)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+// Peers that send simulcast send each video track as several layers, named by
+// rid. Every subscriber gets whichever one layer suits it, and only switches
+// between them on keyframes.
+
+const (
+	// Each peer picks layers for the simulcast tracks it gets this often.
+	layerInterval = time.Second
+	// Layers that haven't sent anything for this long are ignored.
+	layerTimeout = time.Second
+	// Recordings of simulcast tracks use this layer, which clients send at
+	// full resolution.
+	fullLayerRID = "f"
+
+	sdesMidURI         = "urn:ietf:params:rtp-hdrext:sdes:mid"
+	sdesRTPStreamIDURI = "urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id"
+)
+
+type simulcastLayer struct {
+	rid  string
+	ssrc uint32
+	// Bits per second, measured over about a second.
+	bitrate     float64
+	windowStart time.Time
+	windowBytes int
+	lastPacket  time.Time
+}
+
+func (l *simulcastLayer) active(now time.Time) bool {
+	return now.Sub(l.lastPacket) < layerTimeout
+}
+
+// A simulcastTrack relays one simulcast track from peer, with a separate
+// output for each subscriber.
+type simulcastTrack struct {
+	peer     *WebRTCPartyLinePeer
+	id       string
+	streamID string
+	codec    webrtc.RTPCodecCapability
+
+	mutex   sync.Mutex
+	layers  map[string]*simulcastLayer
+	outputs map[*simulcastOutput]bool
+}
+
+// A simulcastOutput is what one subscriber gets of a simulcastTrack. Its
+// fields besides track are guarded by the track's mutex.
+type simulcastOutput struct {
+	track *webrtc.TrackLocalStaticRTP
+
+	current string
+	target  string
+	started bool
+	// Packets are renumbered and retimed so that the subscriber sees one
+	// continuous stream across layer switches.
+	seqOffset       uint16
+	timestampOffset uint32
+	lastSeq         uint16
+	lastTimestamp   uint32
+	lastWrite       time.Time
+}
+
+func newSimulcastTrack(peer *WebRTCPartyLinePeer, track *webrtc.TrackRemote) *simulcastTrack {
+	return &simulcastTrack{
+		peer:     peer,
+		id:       track.ID(),
+		streamID: track.StreamID(),
+		codec:    track.Codec().RTPCodecCapability,
+		layers:   map[string]*simulcastLayer{},
+		outputs:  map[*simulcastOutput]bool{},
+	}
+}
+
+func (st *simulcastTrack) addLayer(rid string, ssrc uint32) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.layers[rid] = &simulcastLayer{rid: rid, ssrc: ssrc}
+}
+
+func (st *simulcastTrack) removeLayer(rid string) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	delete(st.layers, rid)
+}
+
+// subscribe returns a new output, which starts out on the cheapest layer.
+func (st *simulcastTrack) subscribe() (*simulcastOutput, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(st.codec, st.id, st.streamID)
+	if err != nil {
+		return nil, err
+	}
+	out := &simulcastOutput{track: track}
+	st.mutex.Lock()
+	if layers := st.activeLayers(time.Now()); len(layers) > 0 {
+		out.target = layers[0].rid
+	}
+	st.outputs[out] = true
+	st.mutex.Unlock()
+	st.requestKeyframe(out.target)
+	return out, nil
+}
+
+func (st *simulcastTrack) unsubscribe(out *simulcastOutput) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	delete(st.outputs, out)
+}
+
+// Clients name their layers from lowest to highest resolution in this order.
+// It breaks ties between layers with the same bitrate, like all of them
+// before their first bitrate is measured.
+var layerOrder = map[string]int{"q": 0, "h": 1, fullLayerRID: 2}
+
+func layerRank(rid string) int {
+	if rank, ok := layerOrder[rid]; ok {
+		return rank
+	}
+	return len(layerOrder)
+}
+
+// activeLayers returns the layers that are sending, cheapest first.
+func (st *simulcastTrack) activeLayers(now time.Time) []*simulcastLayer {
+	var ret []*simulcastLayer
+	for _, l := range st.layers {
+		if l.active(now) {
+			ret = append(ret, l)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].bitrate != ret[j].bitrate {
+			return ret[i].bitrate < ret[j].bitrate
+		}
+		if ri, rj := layerRank(ret[i].rid), layerRank(ret[j].rid); ri != rj {
+			return ri < rj
+		}
+		return ret[i].rid < ret[j].rid
+	})
+	return ret
+}
+
+// pick switches out to the best layer that fits in budget, in bits per
+// second, or the cheapest if none do or if cheapest is set.
+func (st *simulcastTrack) pick(out *simulcastOutput, budget float64, cheapest bool) {
+	st.mutex.Lock()
+	layers := st.activeLayers(time.Now())
+	if len(layers) == 0 {
+		st.mutex.Unlock()
+		return
+	}
+	target := layers[0]
+	if !cheapest {
+		for _, l := range layers[1:] {
+			if l.bitrate <= budget {
+				target = l
+			}
+		}
+	}
+	changed := out.target != target.rid
+	out.target = target.rid
+	st.mutex.Unlock()
+	if changed && target.rid != out.current {
+		st.requestKeyframe(target.rid)
+	}
+}
+
+// requestKeyframe asks the publisher for a keyframe on a layer, so that
+// outputs waiting to switch to it don't wait for the next regular PLI.
+func (st *simulcastTrack) requestKeyframe(rid string) {
+	st.mutex.Lock()
+	l, ok := st.layers[rid]
+	st.mutex.Unlock()
+	if !ok {
+		return
+	}
+	if err := st.peer.peerConnection.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: l.ssrc},
+	}); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// write sends a packet from one layer to every output that's on it.
+func (st *simulcastTrack) write(rid string, packet *rtp.Packet) {
+	now := time.Now()
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	l, ok := st.layers[rid]
+	if !ok {
+		return
+	}
+	if !l.active(now) {
+		l.windowStart = now
+		l.windowBytes = 0
+	}
+	l.lastPacket = now
+	l.windowBytes += len(packet.Payload)
+	if elapsed := now.Sub(l.windowStart); elapsed >= time.Second {
+		l.bitrate = float64(l.windowBytes*8) / elapsed.Seconds()
+		l.windowStart = now
+		l.windowBytes = 0
+	}
+
+	keyframe := isVP8Keyframe(packet.Payload)
+	for out := range st.outputs {
+		if rid != out.current {
+			if rid != out.target || !keyframe {
+				continue
+			}
+			out.switchTo(rid, packet, st.codec.ClockRate, now)
+		}
+		out.write(packet, now)
+	}
+}
+
+// switchTo makes packet, a keyframe from another layer, follow on from the
+// last packet out sent.
+func (out *simulcastOutput) switchTo(rid string, packet *rtp.Packet, clockRate uint32, now time.Time) {
+	out.current = rid
+	if !out.started {
+		out.started = true
+		return
+	}
+	elapsed := uint32(now.Sub(out.lastWrite).Seconds() * float64(clockRate))
+	if elapsed == 0 {
+		elapsed = 1
+	}
+	out.seqOffset = out.lastSeq + 1 - packet.SequenceNumber
+	out.timestampOffset = out.lastTimestamp + elapsed - packet.Timestamp
+}
+
+func (out *simulcastOutput) write(packet *rtp.Packet, now time.Time) {
+	rewritten := *packet
+	rewritten.SequenceNumber += out.seqOffset
+	rewritten.Timestamp += out.timestampOffset
+	// The publisher's header extensions, like its rid, don't mean anything
+	// to the subscriber.
+	rewritten.Extension = false
+	rewritten.Extensions = nil
+	out.lastSeq = rewritten.SequenceNumber
+	out.lastTimestamp = rewritten.Timestamp
+	out.lastWrite = now
+	// ErrClosedPipe means the subscriber isn't bound yet.
+	out.track.WriteRTP(&rewritten)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+// vp8Packet makes a one-packet VP8 frame. Its payload ends with which layer
+// and frame it is, so tests can tell what came out.
+func vp8Packet(layer byte, frame int, keyframe bool, seq uint16, timestamp uint32) *rtp.Packet {
+	header := byte(0x01)
+	if keyframe {
+		header = 0x00
+	}
+	return &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         true,
+			SequenceNumber: seq,
+			Timestamp:      timestamp,
+		},
+		// The descriptor marks the start of partition 0, then the first
+		// byte of the VP8 frame says whether it's a keyframe.
+		Payload: []byte{0x10, header, layer, byte(frame)},
+	}
+}
+
+// A publisher sends each layer with its own sequence numbers and
+// timestamps.
+type testLayer struct {
+	rid       string
+	seq       uint16
+	timestamp uint32
+	frame     int
+}
+
+func (l *testLayer) send(st *simulcastTrack, keyframe bool) {
+	st.write(l.rid, vp8Packet(l.rid[0], l.frame, keyframe, l.seq, l.timestamp))
+	l.frame++
+	l.seq++
+	l.timestamp += 3000
+}
+
+func TestSimulcastSwitchesOnKeyframes(t *testing.T) {
+	codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	st := &simulcastTrack{
+		codec:   codec,
+		layers:  map[string]*simulcastLayer{},
+		outputs: map[*simulcastOutput]bool{},
+	}
+	st.addLayer("q", 1)
+	st.addLayer("f", 2)
+	track, err := webrtc.NewTrackLocalStaticRTP(codec, "video", "guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &simulcastOutput{track: track, target: "q"}
+	st.outputs[out] = true
+
+	packets := make(chan *rtp.Packet, 100)
+	send, recv := connectPeers(t, []webrtc.TrackLocal{track}, packets)
+	defer send.Close()
+	defer recv.Close()
+
+	// Sequence numbers wrap partway through, too.
+	q := &testLayer{rid: "q", seq: 65532, timestamp: 1000}
+	f := &testLayer{rid: "f", seq: 200, timestamp: 4000000000}
+
+	// Nothing goes out until the target layer's first keyframe.
+	q.send(st, false)
+	f.send(st, true)
+	q.send(st, true)
+	q.send(st, false)
+	f.send(st, false)
+	q.send(st, false)
+
+	// Once the target changes, the old layer keeps going until the new
+	// one has a keyframe.
+	st.mutex.Lock()
+	out.target = "f"
+	st.mutex.Unlock()
+	f.send(st, false)
+	q.send(st, false)
+	f.send(st, true)
+	q.send(st, true)
+	f.send(st, false)
+	f.send(st, false)
+
+	want := []string{"q1", "q2", "q3", "q4", "f3", "f4", "f5"}
+	got := receive(t, packets, len(want))
+	for i, packet := range got {
+		if name := string(packet.Payload[2]) + string('0'+packet.Payload[3]); name != want[i] {
+			t.Errorf("packet %d is %s, want %s", i, name, want[i])
+		}
+		if i == 0 {
+			continue
+		}
+		prev := got[i-1]
+		if packet.SequenceNumber != prev.SequenceNumber+1 {
+			t.Errorf("packet %d has sequence number %d after %d", i, packet.SequenceNumber, prev.SequenceNumber)
+		}
+		step := packet.Timestamp - prev.Timestamp
+		if want[i][0] == want[i-1][0] {
+			if step != 3000 {
+				t.Errorf("packet %d timestamp moved by %d, want 3000", i, step)
+			}
+		} else if step == 0 || step > 9000 {
+			// Across the switch, time moves forward by however long
+			// it's been, which here is next to nothing.
+			t.Errorf("packet %d timestamp moved by %d across a switch", i, step)
+		}
+	}
+}
+
+func TestActiveLayersBeforeBitrates(t *testing.T) {
+	st := &simulcastTrack{layers: map[string]*simulcastLayer{}}
+	now := time.Now()
+	for _, rid := range []string{"f", "q", "h"} {
+		st.addLayer(rid, 0)
+		st.layers[rid].lastPacket = now
+	}
+	for i := 0; i < 10; i++ {
+		layers := st.activeLayers(now)
+		if len(layers) != 3 || layers[0].rid != "q" || layers[1].rid != "h" || layers[2].rid != "f" {
+			t.Fatalf("layers with no bitrate yet come out as %v, %v, %v", layers[0].rid, layers[1].rid, layers[2].rid)
+		}
+	}
+}
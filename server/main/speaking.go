@@ -0,0 +1,81 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+const (
+	audioLevelURI = "urn:ietf:params:rtp-hdrext:ssrc-audio-level"
+
+	// Audio levels are in -dBov, from 0 (loudest) to 127 (silence). Guests
+	// start speaking once their smoothed level gets louder than
+	// speakingLevel, and stop once it's been quieter than quietLevel for
+	// speakingHold, so that pauses between words don't count.
+	speakingLevel = 40
+	quietLevel    = 50
+	speakingHold  = 500 * time.Millisecond
+	// How much each packet's level counts towards the smoothed level.
+	levelSmoothing = 0.1
+
+	// Video from guests who are speaking gets this much more of each
+	// subscriber's bandwidth than video from guests who aren't.
+	speakerWeight = 2
+)
+
+// A speakingDetector decides whether a guest is speaking from the audio
+// levels of its packets.
+type speakingDetector struct {
+	level    float64
+	speaking bool
+	lastLoud time.Time
+}
+
+func newSpeakingDetector() *speakingDetector {
+	return &speakingDetector{level: 127}
+}
+
+// update takes the level of the next packet and returns whether the guest is
+// speaking.
+func (d *speakingDetector) update(level uint8, now time.Time) bool {
+	d.level += (float64(level) - d.level) * levelSmoothing
+	if d.level < quietLevel {
+		d.lastLoud = now
+	}
+	if !d.speaking && d.level < speakingLevel {
+		d.speaking = true
+	} else if d.speaking && now.Sub(d.lastLoud) > speakingHold {
+		d.speaking = false
+	}
+	return d.speaking
+}
+
+// audioLevelID returns the header extension id that receiver's packets carry
+// their audio level in, or 0 if they don't.
+func audioLevelID(receiver *webrtc.RTPReceiver) uint8 {
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		if ext.URI == audioLevelURI {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
+
+// audioLevel reads the audio level out of an RTP packet.
+func audioLevel(packet []byte, id uint8) (uint8, bool) {
+	var header rtp.Header
+	if _, err := header.Unmarshal(packet); err != nil {
+		return 0, false
+	}
+	payload := header.GetExtension(id)
+	if payload == nil {
+		return 0, false
+	}
+	var ext rtp.AudioLevelExtension
+	if err := ext.Unmarshal(payload); err != nil {
+		return 0, false
+	}
+	return ext.Level, true
+}
@@ -6,26 +6,143 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
 	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 	webrtc "github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
 )
 
 // Based on https://github.com/pion/webrtc/tree/master/examples/broadcast
 
 const (
 	rtcpPLIInterval = time.Second * 3
+	// Bandwidth estimates for each peer start here, in bits per second,
+	// until feedback from the peer says otherwise.
+	initialBitrate = 300000
+	// Peers already getting a guest's tracks keep them until they're this
+	// much farther away than the radius, so that someone standing right on
+	// the edge doesn't flicker in and out.
+	proximityHysteresis = 1.1
 )
 
 type WebRTCPartyLine struct {
 	api    *webrtc.API
 	config webrtc.Configuration
 
+	// The congestion controller hands each new PeerConnection's bandwidth
+	// estimator over here, while newPeerMutex is held.
+	newPeerMutex sync.Mutex
+	estimators   chan cc.BandwidthEstimator
+
+	// When AudioRadius or VideoRadius is nonzero, peers only get that kind
+	// of track from guests within that distance of them. Guests without a
+	// position, according to Distance, are near everyone.
+	AudioRadius float64
+	VideoRadius float64
+	Distance    func(a, b uint32) (float64, bool)
+	// When SimulcastRadius is nonzero, peers get the cheapest layer of
+	// simulcast tracks from guests farther away than it.
+	SimulcastRadius float64
+
 	peerListMutex sync.Mutex
 	peers         atomic.Value // []*WebRTCPartyLinePeer
+	serverTracks  []serverTrack
+
+	recordingMutex   sync.Mutex
+	recordableTracks map[*partyLineTrack]bool
+	recording        *trackRecording
+
+	// moderated is a copy of moderation for the read loops, which check it
+	// for every packet.
+	moderationMutex sync.Mutex
+	moderation      map[moderationKey]*moderatedTrack
+	moderated       atomic.Value // map[moderationKey]*moderatedTrack
+	// OnModerated, if set, is called with a guest's moderation when it
+	// changes, and when the guest connects while moderated.
+	OnModerated func(id uint32, m Moderation)
+}
+
+// A relayedTrack is one of a peer's tracks, as sent on to other peers. Tracks
+// without simulcast send everyone the same local track.
+type relayedTrack struct {
+	peer      *WebRTCPartyLinePeer
+	local     webrtc.TrackLocal
+	simulcast *simulcastTrack
+
+	// How many bits per second each subscriber to a track without
+	// simulcast can take of it.
+	budgetMutex sync.Mutex
+	budgets     map[*WebRTCPartyLinePeer]uint64
+}
+
+func (rt *relayedTrack) setBudget(p *WebRTCPartyLinePeer, budget uint64) {
+	rt.budgetMutex.Lock()
+	defer rt.budgetMutex.Unlock()
+	if rt.budgets == nil {
+		rt.budgets = map[*WebRTCPartyLinePeer]uint64{}
+	}
+	rt.budgets[p] = budget
+}
+
+func (rt *relayedTrack) removeBudget(p *WebRTCPartyLinePeer) {
+	rt.budgetMutex.Lock()
+	defer rt.budgetMutex.Unlock()
+	delete(rt.budgets, p)
+}
+
+// bitrate returns how many bits per second the publisher should send of
+// track: enough for the subscriber who can take the most, but no more than
+// max. Simulcast tracks get max, since subscribers who can't take that get a
+// cheaper layer anyway.
+func (rt *relayedTrack) bitrate(max uint64) uint64 {
+	rt.budgetMutex.Lock()
+	defer rt.budgetMutex.Unlock()
+	if rt.simulcast != nil || len(rt.budgets) == 0 {
+		return max
+	}
+	var ret uint64
+	for _, budget := range rt.budgets {
+		if budget > ret {
+			ret = budget
+		}
+	}
+	if ret > max {
+		return max
+	}
+	return ret
+}
+
+func (rt *relayedTrack) kind() webrtc.RTPCodecType {
+	if rt.simulcast != nil {
+		return webrtc.RTPCodecTypeVideo
+	}
+	return rt.local.Kind()
+}
+
+// A forwarding is another peer's track being sent to a peer. Canceling it
+// removes the track.
+type forwarding struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	output *simulcastOutput
+}
+
+// A serverTrack comes from the server itself, not from a peer.
+type serverTrack struct {
+	track webrtc.TrackLocal
+	id    uint32
 }
 
 type WebRTCPartyLinePeer struct {
@@ -33,15 +150,27 @@ type WebRTCPartyLinePeer struct {
 	ctx              context.Context
 	tasks            chan func()
 	peerConnection   *webrtc.PeerConnection
-	tracks           []webrtc.TrackLocal
+	tracks           []*relayedTrack
+	simulcast        map[string]*simulcastTrack
+	forwarded        map[*relayedTrack]forwarding
+	estimator        cc.BandwidthEstimator
+	estimated        int32 // Set once feedback first changes the estimate.
+	lastEstimate     int
+	speaking         int32
 	pendingMids      []func()
 	makingOffer      bool
 	sendAnotherOffer bool
 
 	UserInfo     uint32
+	Role         string
 	MaxBandwidth uint64
 	SendToPeer   func(interface{})
 	MapTrack     func(string, uint32)
+	// SetDebug, if set, shows a value in the peer's guest debug info.
+	SetDebug func(string, interface{})
+	// OnSpeaking, if set, is called when the peer starts or stops
+	// talking.
+	OnSpeaking func(bool)
 }
 
 func NewWebRTCPartyLine(configIn json.RawMessage) *WebRTCPartyLine {
@@ -57,6 +186,9 @@ func NewWebRTCPartyLine(configIn json.RawMessage) *WebRTCPartyLine {
 			ClockRate:   48000,
 			Channels:    2,
 			SDPFmtpLine: "minptime=10;useinbandfec=1",
+			RTCPFeedback: []webrtc.RTCPFeedback{
+				{Type: "transport-cc"},
+			},
 		},
 		PayloadType: 111,
 	}, webrtc.RTPCodecTypeAudio); err != nil {
@@ -65,6 +197,7 @@ func NewWebRTCPartyLine(configIn json.RawMessage) *WebRTCPartyLine {
 
 	videoRTCPFeedback := []webrtc.RTCPFeedback{
 		{Type: "goog-remb"},
+		{Type: "transport-cc"},
 		{Type: "ccm", Parameter: "fir"},
 		{Type: "nack"},
 		{Type: "nack", Parameter: "pli"},
@@ -82,23 +215,87 @@ func NewWebRTCPartyLine(configIn json.RawMessage) *WebRTCPartyLine {
 		panic(err)
 	}
 
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(&mediaEngine))
-	return &WebRTCPartyLine{
-		api:    api,
-		config: config,
+	for _, uri := range []string{sdesMidURI, sdesRTPStreamIDURI} {
+		if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+			panic(err)
+		}
+	}
+	if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: audioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+		panic(err)
+	}
+
+	// Peers send transport-wide congestion control feedback about what
+	// they get, which a send-side estimator turns into a bandwidth
+	// estimate for each of them.
+	pl := &WebRTCPartyLine{
+		config:     config,
+		estimators: make(chan cc.BandwidthEstimator, 1),
+	}
+	registry := &interceptor.Registry{}
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		// Subscribers get whatever publishers send, so there's nothing
+		// to pace; the estimate picks layers and publisher bitrates
+		// instead.
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(initialBitrate),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		panic(err)
+	}
+	congestionController.OnNewPeerConnection(func(id string, estimator cc.BandwidthEstimator) {
+		pl.estimators <- estimator
+	})
+	registry.Add(congestionController)
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(&mediaEngine, registry); err != nil {
+		panic(err)
+	}
+	if err := webrtc.RegisterDefaultInterceptors(&mediaEngine, registry); err != nil {
+		panic(err)
+	}
+
+	pl.api = webrtc.NewAPI(webrtc.WithMediaEngine(&mediaEngine), webrtc.WithInterceptorRegistry(registry))
+	return pl
+}
+
+// relay forwards a packet from a publisher to track, less the publisher's
+// header extensions, like its mid, which use its own ids and don't mean
+// anything to subscribers. packet is just somewhere to unmarshal buf.
+func relay(track *webrtc.TrackLocalStaticRTP, packet *rtp.Packet, buf []byte) error {
+	if err := packet.Unmarshal(buf); err != nil {
+		return err
 	}
+	packet.Extension = false
+	packet.Extensions = nil
+	return track.WriteRTP(packet)
 }
 
 func (pl *WebRTCPartyLine) AddPeer(ctx context.Context, p *WebRTCPartyLinePeer) error {
 	p.partyLine = pl
 	p.ctx = ctx
 	p.tasks = make(chan func(), 64)
+	p.simulcast = map[string]*simulcastTrack{}
+	p.forwarded = map[*relayedTrack]forwarding{}
 
+	pl.newPeerMutex.Lock()
 	var err error
 	p.peerConnection, err = p.partyLine.api.NewPeerConnection(p.partyLine.config)
 	if err != nil {
+		// The estimator may have been made before it failed. Leaving it
+		// would hand it to the next peer, or block its own.
+		select {
+		case <-pl.estimators:
+		default:
+		}
+		pl.newPeerMutex.Unlock()
 		return err
 	}
+	p.estimator = <-pl.estimators
+	pl.newPeerMutex.Unlock()
+	p.estimator.OnTargetBitrateChange(func(int) {
+		atomic.StoreInt32(&p.estimated, 1)
+	})
 
 	if _, err = p.peerConnection.AddTransceiverFromKind(
 		webrtc.RTPCodecTypeAudio,
@@ -140,10 +337,29 @@ func (pl *WebRTCPartyLine) AddPeer(ctx context.Context, p *WebRTCPartyLinePeer)
 
 	p.peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 		p.tasks <- func() {
-			localTrack, err := webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, track.ID(), track.StreamID())
-			if err != nil {
-				fmt.Println("OnTrack err ", err)
-				return
+			// Each simulcast layer shows up as its own track, with a
+			// rid.
+			rid := track.RID()
+			var newTrack *relayedTrack
+			var localTrack *webrtc.TrackLocalStaticRTP
+			var st *simulcastTrack
+			if rid != "" {
+				key := track.StreamID() + " " + track.ID()
+				var ok bool
+				if st, ok = p.simulcast[key]; !ok {
+					st = newSimulcastTrack(p, track)
+					p.simulcast[key] = st
+					newTrack = &relayedTrack{peer: p, simulcast: st}
+				}
+				st.addLayer(rid, uint32(track.SSRC()))
+			} else {
+				var err error
+				localTrack, err = webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, track.ID(), track.StreamID())
+				if err != nil {
+					fmt.Println("OnTrack err ", err)
+					return
+				}
+				newTrack = &relayedTrack{peer: p, local: localTrack}
 			}
 			pliChan := make(chan bool)
 
@@ -162,25 +378,54 @@ func (pl *WebRTCPartyLine) AddPeer(ctx context.Context, p *WebRTCPartyLinePeer)
 				}
 			}()
 
+			relayed := newTrack
+			if st != nil {
+				relayed = nil
+			}
 			go func() {
 				ssrc := uint32(track.SSRC())
-				packets := []rtcp.Packet{
-					&rtcp.ReceiverEstimatedMaximumBitrate{
-						SenderSSRC: ssrc,
-						Bitrate:    p.MaxBandwidth,
-						SSRCs:      []uint32{ssrc},
-					},
-					&rtcp.PictureLossIndication{MediaSSRC: ssrc},
-				}
 				for range pliChan {
+					// Ask for no more than any subscriber can take.
+					bitrate := p.MaxBandwidth
+					if relayed != nil {
+						bitrate = relayed.bitrate(bitrate)
+					}
+					packets := []rtcp.Packet{
+						&rtcp.ReceiverEstimatedMaximumBitrate{
+							SenderSSRC: ssrc,
+							Bitrate:    float32(bitrate),
+							SSRCs:      []uint32{ssrc},
+						},
+						&rtcp.PictureLossIndication{MediaSSRC: ssrc},
+					}
 					if rtcpSendErr := p.peerConnection.WriteRTCP(packets); rtcpSendErr != nil {
 						fmt.Println(rtcpSendErr)
 					}
 				}
 			}()
 
+			var recordable *partyLineTrack
+			if rid == "" || rid == fullLayerRID {
+				recordable = &partyLineTrack{peer: p, kind: track.Kind()}
+				p.partyLine.addRecordableTrack(recordable)
+			}
+
 			go func() {
+				if recordable != nil {
+					defer p.partyLine.removeRecordableTrack(recordable)
+				}
+				if st != nil {
+					defer st.removeLayer(rid)
+				}
+				var levelID uint8
+				var speaking *speakingDetector
+				if track.Kind() == webrtc.RTPCodecTypeAudio {
+					levelID = audioLevelID(receiver)
+					speaking = newSpeakingDetector()
+					defer p.setSpeaking(false)
+				}
 				rtpBuf := make([]byte, 1400)
+				var relayPacket rtp.Packet
 				for {
 					i, _, readErr := track.Read(rtpBuf)
 					if readErr == io.EOF {
@@ -191,28 +436,55 @@ func (pl *WebRTCPartyLine) AddPeer(ctx context.Context, p *WebRTCPartyLinePeer)
 						return
 					}
 
-					// ErrClosedPipe means we don't have any subscribers, this is ok if no peers have connected yet
-					if _, err = localTrack.Write(rtpBuf[:i]); err != nil {
-						fmt.Println("write error, ignoring:", err)
+					if p.partyLine.isModerated(p.UserInfo, track.Kind()) {
+						if speaking != nil {
+							p.setSpeaking(false)
+						}
+						continue
+					}
+
+					if levelID != 0 {
+						if level, ok := audioLevel(rtpBuf[:i], levelID); ok {
+							p.setSpeaking(speaking.update(level, time.Now()))
+						}
+					}
+
+					if st != nil {
+						packet := &rtp.Packet{}
+						if err := packet.Unmarshal(rtpBuf[:i]); err != nil {
+							fmt.Println("bad simulcast packet, ignoring:", err)
+							continue
+						}
+						st.write(rid, packet)
+					} else {
+						// ErrClosedPipe means we don't have any subscribers, this is ok if no peers have connected yet
+						if err := relay(localTrack, &relayPacket, rtpBuf[:i]); err != nil {
+							fmt.Println("write error, ignoring:", err)
+						}
+					}
+					if recordable != nil {
+						recordable.write(rtpBuf[:i])
 					}
 				}
 			}()
 
-			p.tracks = append(p.tracks, localTrack)
+			if newTrack != nil {
+				p.tracks = append(p.tracks, newTrack)
 
-			peers := p.partyLine.peers.Load().([]*WebRTCPartyLinePeer)
-			for i := range peers {
-				peer := peers[i]
-				if peer == p {
-					continue
-				}
-				if peer.peerConnection == nil {
-					continue
-				}
-				peer.tasks <- func() {
-					if err := peer.addTrack(p, localTrack); err != nil {
-						fmt.Println("err tracking upp: ", err)
+				peers := p.partyLine.peers.Load().([]*WebRTCPartyLinePeer)
+				for i := range peers {
+					peer := peers[i]
+					if peer == p {
+						continue
+					}
+					if peer.peerConnection == nil {
+						continue
 					}
+					peer.do(func() {
+						if err := peer.forward(p, newTrack); err != nil {
+							fmt.Println("err tracking upp: ", err)
+						}
+					})
 				}
 			}
 
@@ -228,6 +500,12 @@ func (pl *WebRTCPartyLine) AddPeer(ctx context.Context, p *WebRTCPartyLinePeer)
 	}
 	pl.peerListMutex.Unlock()
 
+	pl.moderationMutex.Lock()
+	if pl.moderationOf(p.UserInfo) != (Moderation{}) {
+		pl.notifyModerated(p.UserInfo)
+	}
+	pl.moderationMutex.Unlock()
+
 	go func() {
 		for {
 			select {
@@ -244,29 +522,61 @@ func (pl *WebRTCPartyLine) AddPeer(ctx context.Context, p *WebRTCPartyLinePeer)
 		pl.RemovePeer(p)
 	}()
 
-	p.tasks <- func() {
+	go func() {
+		ticker := time.NewTicker(layerInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.do(func() {
+					p.reportBandwidth()
+					p.pickLayers()
+				})
+			}
+		}
+	}()
+
+	pl.peerListMutex.Lock()
+	serverTracks := append([]serverTrack(nil), pl.serverTracks...)
+	pl.peerListMutex.Unlock()
+	p.do(func() {
+		for _, st := range serverTracks {
+			if err := p.addTrackFrom(st.id, context.Background(), st.track); err != nil {
+				fmt.Println("err adding server track: ", err)
+			}
+		}
 		peers := p.partyLine.peers.Load().([]*WebRTCPartyLinePeer)
 		for i := range peers {
 			peer := peers[i]
 			if peer == p {
 				continue
 			}
-			peer.tasks <- func() {
-				tracks := append([]webrtc.TrackLocal(nil), peer.tracks...)
-				p.tasks <- func() {
-					for _, track := range tracks {
-						if err := p.addTrack(peer, track); err != nil {
-							fmt.Println("err tracking up: ", err)
-						}
-					}
-				}
-			}
+			p.forwardFrom(peer)
 		}
-	}
+	})
 
 	return nil
 }
 
+// AddServerTrack sends track to every peer, now and later, as if it came from
+// the guest with the given id.
+func (pl *WebRTCPartyLine) AddServerTrack(track webrtc.TrackLocal, id uint32) {
+	pl.peerListMutex.Lock()
+	pl.serverTracks = append(pl.serverTracks, serverTrack{track, id})
+	peers, _ := pl.peers.Load().([]*WebRTCPartyLinePeer)
+	pl.peerListMutex.Unlock()
+	for i := range peers {
+		peer := peers[i]
+		peer.do(func() {
+			if err := peer.addTrackFrom(id, context.Background(), track); err != nil {
+				fmt.Println("err adding server track: ", err)
+			}
+		})
+	}
+}
+
 func (pl *WebRTCPartyLine) RemovePeer(p *WebRTCPartyLinePeer) {
 	pl.peerListMutex.Lock()
 	peers := p.partyLine.peers.Load().([]*WebRTCPartyLinePeer)
@@ -281,6 +591,24 @@ func (pl *WebRTCPartyLine) RemovePeer(p *WebRTCPartyLinePeer) {
 	p.peerConnection.Close()
 }
 
+// Close hangs up on every peer and stops recording and timed moderation, once
+// the party line's room is gone.
+func (pl *WebRTCPartyLine) Close() {
+	peers, _ := pl.peers.Load().([]*WebRTCPartyLinePeer)
+	for _, p := range peers {
+		pl.RemovePeer(p)
+	}
+	pl.StopRecording()
+	pl.moderationMutex.Lock()
+	for key, mt := range pl.moderation {
+		if mt.timer != nil {
+			mt.timer.Stop()
+		}
+		pl.setModeration(key, nil)
+	}
+	pl.moderationMutex.Unlock()
+}
+
 func (p *WebRTCPartyLinePeer) sendOffer(restartIce bool) error {
 	if !restartIce && p.makingOffer {
 		p.sendAnotherOffer = true
@@ -308,24 +636,239 @@ func (p *WebRTCPartyLinePeer) sendOffer(restartIce bool) error {
 	return nil
 }
 
-func (p *WebRTCPartyLinePeer) addTrack(peer *WebRTCPartyLinePeer, track webrtc.TrackLocal) error {
+// do runs f on p's task goroutine, unless p is gone.
+func (p *WebRTCPartyLinePeer) do(f func()) {
+	select {
+	case p.tasks <- f:
+	case <-p.ctx.Done():
+	}
+}
+
+// wants says whether p should get track from source, based on how far apart
+// they are.
+func (p *WebRTCPartyLinePeer) wants(source *WebRTCPartyLinePeer, track *relayedTrack) bool {
+	pl := p.partyLine
+	radius := pl.AudioRadius
+	if track.kind() == webrtc.RTPCodecTypeVideo {
+		radius = pl.VideoRadius
+	}
+	if radius <= 0 || pl.Distance == nil {
+		return true
+	}
+	distance, ok := pl.Distance(p.UserInfo, source.UserInfo)
+	if !ok {
+		return true
+	}
+	if _, ok := p.forwarded[track]; ok {
+		radius *= proximityHysteresis
+	}
+	return distance <= radius
+}
+
+// forward starts or stops sending track from source to p, depending on
+// whether p wants it. It runs on p's task goroutine.
+func (p *WebRTCPartyLinePeer) forward(source *WebRTCPartyLinePeer, track *relayedTrack) error {
+	f, forwarded := p.forwarded[track]
+	if want := p.wants(source, track); want == forwarded {
+		return nil
+	} else if !want {
+		f.cancel()
+		delete(p.forwarded, track)
+		track.removeBudget(p)
+		return nil
+	}
+	local := track.local
+	var output *simulcastOutput
+	if track.simulcast != nil {
+		var err error
+		if output, err = track.simulcast.subscribe(); err != nil {
+			return err
+		}
+		local = output.track
+	}
+	ctx, cancel := context.WithCancel(source.ctx)
+	if err := p.addTrackFrom(source.UserInfo, ctx, local); err != nil {
+		cancel()
+		if output != nil {
+			track.simulcast.unsubscribe(output)
+		}
+		return err
+	}
+	p.forwarded[track] = forwarding{ctx, cancel, output}
+	go func() {
+		if output != nil {
+			defer track.simulcast.unsubscribe(output)
+		}
+		select {
+		case <-ctx.Done():
+			p.do(func() {
+				if p.forwarded[track].ctx == ctx {
+					delete(p.forwarded, track)
+					track.removeBudget(p)
+				}
+			})
+		case <-p.ctx.Done():
+			cancel()
+		}
+	}()
+	return nil
+}
+
+// forwardFrom calls forward for each of source's tracks.
+func (p *WebRTCPartyLinePeer) forwardFrom(source *WebRTCPartyLinePeer) {
+	source.do(func() {
+		tracks := append([]*relayedTrack(nil), source.tracks...)
+		p.do(func() {
+			for _, track := range tracks {
+				if err := p.forward(source, track); err != nil {
+					fmt.Println("err tracking up: ", err)
+				}
+			}
+		})
+	})
+}
+
+// bandwidth returns how many bits per second p can take, going by its
+// MaxBandwidth and the estimate of what it can take. Until there's an
+// estimate, it's initialBitrate.
+func (p *WebRTCPartyLinePeer) bandwidth() uint64 {
+	if !p.hasEstimate() {
+		if initialBitrate < p.MaxBandwidth {
+			return initialBitrate
+		}
+		return p.MaxBandwidth
+	}
+	if estimate := uint64(p.estimator.GetTargetBitrate()); estimate > 0 && estimate < p.MaxBandwidth {
+		return estimate
+	}
+	return p.MaxBandwidth
+}
+
+func (p *WebRTCPartyLinePeer) hasEstimate() bool {
+	return atomic.LoadInt32(&p.estimated) != 0
+}
+
+// reportBandwidth shows the bandwidth estimate in p's debug info when it
+// changes.
+func (p *WebRTCPartyLinePeer) reportBandwidth() {
+	estimate := p.estimator.GetTargetBitrate()
+	if estimate == p.lastEstimate || p.SetDebug == nil {
+		return
+	}
+	p.lastEstimate = estimate
+	p.SetDebug("bandwidthEstimate", estimate)
+}
+
+func (p *WebRTCPartyLinePeer) setSpeaking(speaking bool) {
+	var v int32
+	if speaking {
+		v = 1
+	}
+	if atomic.SwapInt32(&p.speaking, v) != v && p.OnSpeaking != nil {
+		p.OnSpeaking(speaking)
+	}
+}
+
+func (p *WebRTCPartyLinePeer) isSpeaking() bool {
+	return atomic.LoadInt32(&p.speaking) != 0
+}
+
+// pickLayers chooses a layer of each simulcast track p gets, splitting its
+// bandwidth between every video track it gets, with more for guests who are
+// speaking. Until there's a bandwidth estimate, it sticks to the cheapest
+// layers. It runs on p's task goroutine.
+func (p *WebRTCPartyLinePeer) pickLayers() {
+	weight := func(track *relayedTrack) float64 {
+		if track.peer.isSpeaking() {
+			return speakerWeight
+		}
+		return 1
+	}
+	var weights float64
+	for track := range p.forwarded {
+		if track.kind() == webrtc.RTPCodecTypeVideo {
+			weights += weight(track)
+		}
+	}
+	if weights == 0 {
+		return
+	}
+	pl := p.partyLine
+	for track, f := range p.forwarded {
+		if track.kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		budget := float64(p.bandwidth()) * weight(track) / weights
+		if f.output == nil {
+			track.setBudget(p, uint64(budget))
+			continue
+		}
+		cheapest := !p.hasEstimate()
+		if !cheapest && pl.SimulcastRadius > 0 && pl.Distance != nil {
+			if distance, ok := pl.Distance(p.UserInfo, track.peer.UserInfo); ok {
+				cheapest = distance > pl.SimulcastRadius
+			}
+		}
+		track.simulcast.pick(f.output, budget, cheapest)
+	}
+}
+
+// Moved rechecks which tracks the guest with the given id should get and
+// send, for when it might have moved.
+func (pl *WebRTCPartyLine) Moved(id uint32) {
+	if pl.AudioRadius <= 0 && pl.VideoRadius <= 0 {
+		return
+	}
+	peers, _ := pl.peers.Load().([]*WebRTCPartyLinePeer)
+	var moved *WebRTCPartyLinePeer
+	for _, peer := range peers {
+		if peer.UserInfo == id {
+			moved = peer
+		}
+	}
+	if moved == nil {
+		return
+	}
+	for _, peer := range peers {
+		if peer == moved || peer.peerConnection == nil {
+			continue
+		}
+		moved.forwardFrom(peer)
+		peer.forwardFrom(moved)
+	}
+}
+
+// addTrackFrom sends track to p as if it came from the guest with the given
+// id, until ctx is done.
+func (p *WebRTCPartyLinePeer) addTrackFrom(id uint32, ctx context.Context, track webrtc.TrackLocal) error {
 	transceiver, err := p.peerConnection.AddTransceiverFromTrack(track)
 	if err != nil {
 		return err
 	}
 
 	p.pendingMids = append(p.pendingMids, func() {
-		p.MapTrack(transceiver.Mid(), peer.UserInfo)
+		p.MapTrack(transceiver.Mid(), id)
 	})
 
+	// Feedback only reaches the interceptors, like the congestion
+	// controller, if something reads it.
+	go func() {
+		sender := transceiver.Sender()
+		for {
+			if _, _, err := sender.ReadRTCP(); err != nil {
+				return
+			}
+		}
+	}()
+
 	go func() {
 		select {
-		case <-peer.ctx.Done():
-			p.tasks <- func() {
+		case <-ctx.Done():
+			p.do(func() {
 				if err := p.peerConnection.RemoveTrack(transceiver.Sender()); err != nil {
 					fmt.Println("error removing old track: ", err)
 				}
-			}
+			})
 		case <-p.ctx.Done():
 		}
 	}()
@@ -361,6 +904,33 @@ func (p *WebRTCPartyLinePeer) HandleMessage(message json.RawMessage) error {
 				p.sendOffer(false)
 			}
 		}
+	case "offer":
+		var sessionDescription webrtc.SessionDescription
+		if err := json.Unmarshal(messageBody, &sessionDescription); err != nil {
+			fmt.Println("failed to unmarshal rtc offer: ", messageBody)
+		}
+		p.tasks <- func() {
+			// Clients offer when they want to send simulcast, which only
+			// the offerer can set up. If both sides offer at once, the
+			// client gives way.
+			if p.makingOffer {
+				return
+			}
+			if err := p.peerConnection.SetRemoteDescription(sessionDescription); err != nil {
+				fmt.Println("failed to use offer: ", err)
+				return
+			}
+			answer, err := p.peerConnection.CreateAnswer(nil)
+			if err != nil {
+				fmt.Println("failed to answer: ", err)
+				return
+			}
+			if err := p.peerConnection.SetLocalDescription(answer); err != nil {
+				fmt.Println("failed to use answer: ", err)
+				return
+			}
+			p.SendToPeer([]interface{}{"answer", answer})
+		}
 	case "renegotiate":
 		p.tasks <- func() {
 			if err := p.sendOffer(false); err != nil {
@@ -388,3 +958,270 @@ func (p *WebRTCPartyLinePeer) HandleMessage(message json.RawMessage) error {
 	}
 	return nil
 }
+
+// Recordings start a new file this often, unless told otherwise.
+const defaultRecordingRotation = 30 * time.Minute
+
+// A RecordingFilter picks which tracks to record: ones from any of Guests or
+// with any of Roles (like "cast"). An empty filter records everything.
+type RecordingFilter struct {
+	Guests []uint32 `json:"guests"`
+	Roles  []string `json:"roles"`
+}
+
+func (f RecordingFilter) matches(p *WebRTCPartyLinePeer) bool {
+	if len(f.Guests) == 0 && len(f.Roles) == 0 {
+		return true
+	}
+	for _, id := range f.Guests {
+		if id == p.UserInfo {
+			return true
+		}
+	}
+	for _, role := range f.Roles {
+		if role == p.Role {
+			return true
+		}
+	}
+	return false
+}
+
+type trackRecording struct {
+	dir    string
+	prefix string
+	rotate time.Duration
+	filter RecordingFilter
+}
+
+// A partyLineTrack is a track that a peer sends to the party line, which
+// might be getting recorded.
+type partyLineTrack struct {
+	peer *WebRTCPartyLinePeer
+	kind webrtc.RTPCodecType
+
+	mutex  sync.Mutex
+	writer *trackWriter
+}
+
+func (t *partyLineTrack) write(buf []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.writer != nil {
+		t.writer.write(buf)
+	}
+}
+
+func (t *partyLineTrack) setWriter(writer *trackWriter) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.writer != nil {
+		t.writer.close()
+	}
+	t.writer = writer
+}
+
+type mediaWriter interface {
+	WriteRTP(*rtp.Packet) error
+	Close() error
+}
+
+// trackWriter writes a track to Ogg (Opus) or IVF (VP8) files named for
+// when they start, and starts a new one every so often.
+type trackWriter struct {
+	base   string
+	kind   webrtc.RTPCodecType
+	rotate time.Duration
+	opened time.Time
+	w      mediaWriter
+}
+
+func (tw *trackWriter) open() error {
+	tw.opened = time.Now()
+	ext := ".ivf"
+	if tw.kind == webrtc.RTPCodecTypeAudio {
+		ext = ".ogg"
+	}
+	f, err := createNew(tw.base+"-"+tw.opened.Format("20060102-150405.000"), ext)
+	if err != nil {
+		return err
+	}
+	if tw.kind == webrtc.RTPCodecTypeAudio {
+		tw.w, err = oggwriter.NewWith(f, 48000, 2)
+	} else {
+		tw.w, err = ivfwriter.NewWith(f)
+	}
+	if err != nil {
+		f.Close()
+	}
+	return err
+}
+
+// createNew creates a file named base+ext, or base-1+ext and so on if that's
+// taken, without ever replacing one.
+func createNew(base, ext string) (*os.File, error) {
+	path := base + ext
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) {
+			return f, err
+		}
+		path = fmt.Sprint(base, "-", i, ext)
+	}
+}
+
+func (tw *trackWriter) write(buf []byte) {
+	var packet rtp.Packet
+	if err := packet.Unmarshal(buf); err != nil {
+		return
+	}
+	due := tw.w == nil || tw.rotate > 0 && time.Since(tw.opened) > tw.rotate
+	// Video files have to start with a keyframe to be any use.
+	if due && (tw.kind == webrtc.RTPCodecTypeAudio || isVP8Keyframe(packet.Payload)) {
+		tw.close()
+		if err := tw.open(); err != nil {
+			fmt.Println("can't record track:", err)
+			tw.w = nil
+			return
+		}
+	}
+	if tw.w == nil {
+		return
+	}
+	if err := tw.w.WriteRTP(&packet); err != nil {
+		fmt.Println("error recording track:", err)
+	}
+}
+
+func (tw *trackWriter) close() {
+	if tw.w != nil {
+		tw.w.Close()
+		tw.w = nil
+	}
+}
+
+// isVP8Keyframe says whether an RTP payload starts a VP8 keyframe, going by
+// https://tools.ietf.org/html/rfc7741#section-4.2.
+func isVP8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	i := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) < 2 {
+			return false
+		}
+		x := payload[1]
+		i = 2
+		if x&0x80 != 0 {
+			if len(payload) <= i {
+				return false
+			}
+			if payload[i]&0x80 != 0 {
+				i += 2
+			} else {
+				i += 1
+			}
+		}
+		if x&0x40 != 0 {
+			i += 1
+		}
+		if x&0x30 != 0 {
+			i += 1
+		}
+	}
+	start := payload[0]&0x10 != 0
+	partition := payload[0] & 0x07
+	return start && partition == 0 && len(payload) > i && payload[i]&0x01 == 0
+}
+
+func (pl *WebRTCPartyLine) writerFor(t *partyLineTrack) *trackWriter {
+	rec := pl.recording
+	if rec == nil || !rec.filter.matches(t.peer) {
+		return nil
+	}
+	kind := "video"
+	if t.kind == webrtc.RTPCodecTypeAudio {
+		kind = "audio"
+	}
+	return &trackWriter{
+		base:   filepath.Join(rec.dir, fmt.Sprint(rec.prefix, t.peer.UserInfo, "-", kind)),
+		kind:   t.kind,
+		rotate: rec.rotate,
+	}
+}
+
+func (pl *WebRTCPartyLine) addRecordableTrack(t *partyLineTrack) {
+	pl.recordingMutex.Lock()
+	defer pl.recordingMutex.Unlock()
+	if pl.recordableTracks == nil {
+		pl.recordableTracks = map[*partyLineTrack]bool{}
+	}
+	pl.recordableTracks[t] = true
+	if writer := pl.writerFor(t); writer != nil {
+		t.setWriter(writer)
+	}
+}
+
+func (pl *WebRTCPartyLine) removeRecordableTrack(t *partyLineTrack) {
+	pl.recordingMutex.Lock()
+	defer pl.recordingMutex.Unlock()
+	delete(pl.recordableTracks, t)
+	t.setWriter(nil)
+}
+
+// StartRecording records the tracks that filter picks, now and as they
+// appear, into files in dir that start with prefix. Starting again replaces
+// the filter.
+func (pl *WebRTCPartyLine) StartRecording(dir, prefix string, rotate time.Duration, filter RecordingFilter) {
+	if rotate == 0 {
+		rotate = defaultRecordingRotation
+	}
+	pl.recordingMutex.Lock()
+	defer pl.recordingMutex.Unlock()
+	pl.recording = &trackRecording{dir, prefix, rotate, filter}
+	for t := range pl.recordableTracks {
+		t.setWriter(pl.writerFor(t))
+	}
+}
+
+func (pl *WebRTCPartyLine) StopRecording() {
+	pl.recordingMutex.Lock()
+	defer pl.recordingMutex.Unlock()
+	pl.recording = nil
+	for t := range pl.recordableTracks {
+		t.setWriter(nil)
+	}
+}
+
+// Recording returns the filter for tracks being recorded, if any.
+func (pl *WebRTCPartyLine) Recording() (RecordingFilter, bool) {
+	pl.recordingMutex.Lock()
+	defer pl.recordingMutex.Unlock()
+	if pl.recording == nil {
+		return RecordingFilter{}, false
+	}
+	return pl.recording.filter, true
+}
+
+type RecordingFile struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Modified int64  `json:"modified"`
+}
+
+// ListRecordings returns the recordings in dir, newest first.
+func ListRecordings(dir string) ([]RecordingFile, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ret := []RecordingFile{}
+	for _, info := range infos {
+		if ext := filepath.Ext(info.Name()); info.IsDir() || ext != ".ogg" && ext != ".ivf" {
+			continue
+		}
+		ret = append(ret, RecordingFile{info.Name(), info.Size(), info.ModTime().UnixNano() / int64(time.Millisecond)})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Modified > ret[j].Modified })
+	return ret, nil
+}
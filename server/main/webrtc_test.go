@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+func TestCreateNewNeverReplaces(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "1-audio-20200626-210000.000")
+	for _, want := range []string{base + ".ogg", base + "-1.ogg", base + "-2.ogg"} {
+		f, err := createNew(base, ".ogg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if f.Name() != want {
+			t.Errorf("created %s, want %s", f.Name(), want)
+		}
+	}
+}
+
+func TestModerateUnknownGuest(t *testing.T) {
+	pl := &WebRTCPartyLine{}
+	pl.peers.Store([]*WebRTCPartyLinePeer{{UserInfo: 1}})
+	if err := pl.Moderate(2, webrtc.RTPCodecTypeAudio, true, 0); err == nil {
+		t.Error("moderated a guest who isn't here")
+	}
+	if err := pl.Moderate(1, webrtc.RTPCodecTypeAudio, true, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !pl.isModerated(1, webrtc.RTPCodecTypeAudio) || pl.isModerated(1, webrtc.RTPCodecTypeVideo) {
+		t.Errorf("moderation is %+v", pl.Moderation(1))
+	}
+	pl.ForgetModeration(1)
+	if pl.Moderation(1) != (Moderation{}) {
+		t.Errorf("moderation is %+v after leaving", pl.Moderation(1))
+	}
+}
+
+func TestRelayStripsHeaderExtensions(t *testing.T) {
+	codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	track, err := webrtc.NewTrackLocalStaticRTP(codec, "video", "guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := make(chan *rtp.Packet, 100)
+	send, recv := connectPeers(t, []webrtc.TrackLocal{track}, packets)
+	defer send.Close()
+	defer recv.Close()
+
+	// A packet as a publisher sends it, with its mid in an extension.
+	published := vp8Packet('x', 0, true, 1, 1000)
+	if err := published.SetExtension(3, []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := published.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packet rtp.Packet
+	for i := 0; i < 10; i++ {
+		if err := relay(track, &packet, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := receive(t, packets, 1)[0]
+	if got.Extension || len(got.Extensions) != 0 {
+		t.Errorf("relayed packet has extensions %v", got.Extensions)
+	}
+}
+
+func TestLiftingVideoModerationRequestsKeyframes(t *testing.T) {
+	codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	track, err := webrtc.NewTrackLocalStaticRTP(codec, "video", "guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := make(chan *rtp.Packet, 100)
+	send, recv := connectPeers(t, []webrtc.TrackLocal{track}, packets)
+	defer send.Close()
+	defer recv.Close()
+	for i := 0; i < 10; i++ {
+		if err := track.WriteRTP(vp8Packet('x', i, i == 0, uint16(i), uint32(i*3000))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive(t, packets, 1)
+
+	plis := make(chan bool, 10)
+	go func() {
+		for {
+			got, _, err := send.GetSenders()[0].ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, packet := range got {
+				if _, ok := packet.(*rtcp.PictureLossIndication); ok {
+					plis <- true
+				}
+			}
+		}
+	}()
+
+	pl := &WebRTCPartyLine{}
+	pl.peers.Store([]*WebRTCPartyLinePeer{{UserInfo: 1, peerConnection: recv}})
+	for _, d := range []time.Duration{0, 50 * time.Millisecond} {
+		if err := pl.Moderate(1, webrtc.RTPCodecTypeVideo, true, d); err != nil {
+			t.Fatal(err)
+		}
+		if d == 0 {
+			if err := pl.Moderate(1, webrtc.RTPCodecTypeVideo, false, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		select {
+		case <-plis:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no keyframe request after video moderation for %v ended", d)
+		}
+	}
+}
+
+func TestAddPeerAfterFailedPeerConnection(t *testing.T) {
+	pl := NewWebRTCPartyLine(json.RawMessage(`{"iceServers": [{"urls": ["bogus"]}]}`))
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			ctx, cancel := context.WithCancel(context.Background())
+			if err := pl.AddPeer(ctx, &WebRTCPartyLinePeer{UserInfo: uint32(i)}); err == nil {
+				t.Error("added a peer with a bad configuration")
+			}
+			cancel()
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("adding peers got stuck after a peer connection failed")
+	}
+	if len(pl.estimators) != 0 {
+		t.Error("a failed peer connection left its estimator behind")
+	}
+}
@@ -0,0 +1,189 @@
+// Package osc reads and writes Open Sound Control 1.0 packets.
+package osc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+type Message struct {
+	Address string
+	Args    []interface{}
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+func readString(data []byte) (string, []byte, error) {
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return "", nil, errors.New("unterminated string")
+	}
+	n := pad4(end + 1)
+	if n > len(data) {
+		return "", nil, errors.New("truncated string")
+	}
+	return string(data[:end]), data[n:], nil
+}
+
+func readN(data []byte, n int) ([]byte, []byte, error) {
+	if len(data) < n {
+		return nil, nil, errors.New("truncated argument")
+	}
+	return data[:n], data[n:], nil
+}
+
+// Parse returns the messages in a packet, flattening any bundles.
+func Parse(data []byte) ([]Message, error) {
+	if bytes.HasPrefix(data, []byte("#bundle\x00")) {
+		return parseBundle(data[8:])
+	}
+	msg, err := parseMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	return []Message{msg}, nil
+}
+
+func parseBundle(data []byte) ([]Message, error) {
+	// Skip the time tag; everything happens right away.
+	_, data, err := readN(data, 8)
+	if err != nil {
+		return nil, err
+	}
+	ret := []Message{}
+	for len(data) > 0 {
+		var size []byte
+		if size, data, err = readN(data, 4); err != nil {
+			return nil, err
+		}
+		var element []byte
+		if element, data, err = readN(data, int(binary.BigEndian.Uint32(size))); err != nil {
+			return nil, err
+		}
+		msgs, err := Parse(element)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, msgs...)
+	}
+	return ret, nil
+}
+
+func parseMessage(data []byte) (Message, error) {
+	var msg Message
+	var err error
+	if msg.Address, data, err = readString(data); err != nil {
+		return msg, err
+	}
+	if len(data) == 0 {
+		return msg, nil
+	}
+	var tags string
+	if tags, data, err = readString(data); err != nil {
+		return msg, err
+	}
+	if len(tags) == 0 || tags[0] != ',' {
+		return msg, errors.New(fmt.Sprint("bad type tags: ", tags))
+	}
+	for _, tag := range tags[1:] {
+		var arg []byte
+		switch tag {
+		case 'i':
+			if arg, data, err = readN(data, 4); err == nil {
+				msg.Args = append(msg.Args, int32(binary.BigEndian.Uint32(arg)))
+			}
+		case 'f':
+			if arg, data, err = readN(data, 4); err == nil {
+				msg.Args = append(msg.Args, math.Float32frombits(binary.BigEndian.Uint32(arg)))
+			}
+		case 'h':
+			if arg, data, err = readN(data, 8); err == nil {
+				msg.Args = append(msg.Args, int64(binary.BigEndian.Uint64(arg)))
+			}
+		case 'd':
+			if arg, data, err = readN(data, 8); err == nil {
+				msg.Args = append(msg.Args, math.Float64frombits(binary.BigEndian.Uint64(arg)))
+			}
+		case 's':
+			var s string
+			if s, data, err = readString(data); err == nil {
+				msg.Args = append(msg.Args, s)
+			}
+		case 'b':
+			if arg, data, err = readN(data, 4); err == nil {
+				n := int(binary.BigEndian.Uint32(arg))
+				if arg, data, err = readN(data, pad4(n)); err == nil {
+					msg.Args = append(msg.Args, arg[:n])
+				}
+			}
+		case 'T':
+			msg.Args = append(msg.Args, true)
+		case 'F':
+			msg.Args = append(msg.Args, false)
+		case 'N':
+			msg.Args = append(msg.Args, nil)
+		default:
+			return msg, errors.New(fmt.Sprint("unsupported type tag: ", string(tag)))
+		}
+		if err != nil {
+			return msg, err
+		}
+	}
+	return msg, nil
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	buf.WriteString(s)
+	buf.Write(make([]byte, pad4(len(s)+1)-len(s)))
+}
+
+// Marshal encodes a message. Args can be int32, int64, float32, float64,
+// string, []byte, bool or nil.
+func (m Message) Marshal() ([]byte, error) {
+	tags := []byte{','}
+	var args bytes.Buffer
+	for _, arg := range m.Args {
+		switch arg := arg.(type) {
+		case int32:
+			tags = append(tags, 'i')
+			binary.Write(&args, binary.BigEndian, arg)
+		case int64:
+			tags = append(tags, 'h')
+			binary.Write(&args, binary.BigEndian, arg)
+		case float32:
+			tags = append(tags, 'f')
+			binary.Write(&args, binary.BigEndian, arg)
+		case float64:
+			tags = append(tags, 'd')
+			binary.Write(&args, binary.BigEndian, arg)
+		case string:
+			tags = append(tags, 's')
+			writeString(&args, arg)
+		case []byte:
+			tags = append(tags, 'b')
+			binary.Write(&args, binary.BigEndian, int32(len(arg)))
+			args.Write(arg)
+			args.Write(make([]byte, pad4(len(arg))-len(arg)))
+		case bool:
+			if arg {
+				tags = append(tags, 'T')
+			} else {
+				tags = append(tags, 'F')
+			}
+		case nil:
+			tags = append(tags, 'N')
+		default:
+			return nil, errors.New(fmt.Sprintf("can't send %T over OSC", arg))
+		}
+	}
+	var buf bytes.Buffer
+	writeString(&buf, m.Address)
+	writeString(&buf, string(tags))
+	buf.Write(args.Bytes())
+	return buf.Bytes(), nil
+}
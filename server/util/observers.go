@@ -2,42 +2,221 @@ package util
 
 import (
 	"context"
+	"fmt"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 )
 
-type Observers struct {
-	mutex     sync.RWMutex
-	observers map[context.Context]map[interface{}][]interface{}
+// Each handler can fall this many events behind unless it says otherwise.
+const defaultQueueSize = 256
+
+// Overflow says what to do with an event for a handler whose queue is full.
+type Overflow int
+
+const (
+	// DropOldest throws away the oldest queued event to make room.
+	DropOldest Overflow = iota
+	// DropSubscriber unsubscribes the handler.
+	DropSubscriber
+	// Coalesce drops a queued event with the same Key, or the oldest one if
+	// there isn't one.
+	Coalesce
+)
+
+type Options[T any] struct {
+	QueueSize int
+	Overflow  Overflow
+	Key       func(T) interface{}
+	// Initial events are handled before any that happen after Add.
+	Initial []T
+}
+
+// Observers calls handlers with events of type T. Every handler runs on its
+// own goroutine, with its own queue, so a slow one can't hold up whoever sent
+// the event or the other handlers. A handler that panics is logged and
+// skipped.
+type Observers[T any] struct {
+	mutex       sync.RWMutex
+	seq         uint64
+	subscribers map[uint64]*subscriber[T]
+	dropped     uint64
+}
+
+// A Subscription stops a handler from getting any more events. Handlers also
+// stop when the context they were added with is done.
+type Subscription struct {
+	unsubscribe func()
+	dropped     *uint64
+}
+
+func (s Subscription) Unsubscribe() {
+	if s.unsubscribe != nil {
+		s.unsubscribe()
+	}
+}
+
+// Dropped returns how many events the handler missed because it fell
+// behind.
+func (s Subscription) Dropped() uint64 {
+	if s.dropped == nil {
+		return 0
+	}
+	return atomic.LoadUint64(s.dropped)
+}
+
+type subscriber[T any] struct {
+	handler func(T)
+	opts    Options[T]
+	mutex   sync.Mutex
+	queue   []T
+	wake    chan struct{}
+	done    chan struct{}
+	stopped sync.Once
+	dropped uint64
+}
+
+func (s *subscriber[T]) stop() {
+	s.stopped.Do(func() { close(s.done) })
+}
+
+// push queues an event, and returns how many were dropped to do it and
+// whether the subscriber should be dropped instead.
+func (s *subscriber[T]) push(event T) (uint64, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var dropped uint64
+	if len(s.queue) >= s.opts.QueueSize {
+		switch s.opts.Overflow {
+		case DropSubscriber:
+			return uint64(len(s.queue)) + 1, false
+		case Coalesce:
+			if s.opts.Key != nil {
+				key := s.opts.Key(event)
+				for i := range s.queue {
+					if s.opts.Key(s.queue[i]) == key {
+						s.queue = append(s.queue[:i:i], s.queue[i+1:]...)
+						s.queue = append(s.queue, event)
+						return 1, true
+					}
+				}
+			}
+		}
+		s.queue = s.queue[1:]
+		dropped = 1
+	}
+	s.queue = append(s.queue, event)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return dropped, true
 }
 
-func (o *Observers) Add(ctx context.Context, e interface{}, handler interface{}) {
+func (s *subscriber[T]) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+		}
+		s.mutex.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.mutex.Unlock()
+		for _, event := range queue {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			call(s.handler, event)
+		}
+	}
+}
+
+func (o *Observers[T]) Add(ctx context.Context, handler func(T), opts ...Options[T]) Subscription {
+	s := &subscriber[T]{
+		handler: handler,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if len(opts) > 0 {
+		s.opts = opts[0]
+	}
+	if s.opts.QueueSize <= 0 {
+		s.opts.QueueSize = defaultQueueSize
+	}
+	if len(s.opts.Initial) > 0 {
+		s.queue = s.opts.Initial
+		s.opts.Initial = nil
+		s.wake <- struct{}{}
+	}
+
 	o.mutex.Lock()
 	defer o.mutex.Unlock()
-	if o.observers == nil {
-		o.observers = map[context.Context]map[interface{}][]interface{}{}
+	if o.subscribers == nil {
+		o.subscribers = map[uint64]*subscriber[T]{}
 	}
-	obs, ok := o.observers[ctx]
-	if !ok {
-		obs = map[interface{}][]interface{}{}
-		o.observers[ctx] = obs
-		go func() {
-			<-ctx.Done()
-			o.mutex.Lock()
-			defer o.mutex.Unlock()
-			delete(o.observers, ctx)
-		}()
+	o.seq += 1
+	id := o.seq
+	o.subscribers[id] = s
+	unsubscribe := func() {
+		s.stop()
+		o.mutex.Lock()
+		defer o.mutex.Unlock()
+		delete(o.subscribers, id)
 	}
-	obs[e] = append(obs[e], handler)
+	go func() {
+		select {
+		case <-ctx.Done():
+			unsubscribe()
+		case <-s.done:
+		}
+	}()
+	go s.run()
+	return Subscription{unsubscribe, &s.dropped}
 }
 
-func (o *Observers) Get(e interface{}) []interface{} {
+func (o *Observers[T]) Notify(event T) {
 	o.mutex.RLock()
-	defer o.mutex.RUnlock()
-	ret := []interface{}{}
-	for _, v := range o.observers {
-		if obs, ok := v[e]; ok {
-			ret = append(ret, obs...)
+	var overflowed []uint64
+	for id, s := range o.subscribers {
+		dropped, ok := s.push(event)
+		if dropped > 0 {
+			atomic.AddUint64(&s.dropped, dropped)
+			atomic.AddUint64(&o.dropped, dropped)
+		}
+		if !ok {
+			overflowed = append(overflowed, id)
+		}
+	}
+	o.mutex.RUnlock()
+	if len(overflowed) == 0 {
+		return
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for _, id := range overflowed {
+		if s, ok := o.subscribers[id]; ok {
+			fmt.Println("dropping observer that fell behind")
+			delete(o.subscribers, id)
+			s.stop()
 		}
 	}
-	return ret
+}
+
+// Dropped returns how many events every handler together has missed because
+// it fell behind.
+func (o *Observers[T]) Dropped() uint64 {
+	return atomic.LoadUint64(&o.dropped)
+}
+
+func call[T any](handler func(T), event T) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("observer panicked: %v\n%s", r, debug.Stack())
+		}
+	}()
+	handler(event)
 }
@@ -0,0 +1,143 @@
+package world
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+)
+
+// Codec is how messages are encoded on a guest's WebSocket. Clients pick one
+// by asking for its subprotocol, and get JSON if they don't ask for any.
+type Codec interface {
+	Subprotocol() string
+	MessageType() int
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Subprotocol() string                        { return "" }
+func (jsonCodec) MessageType() int                           { return websocket.TextMessage }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+var cborDecMode = func() cbor.DecMode {
+	dm, err := cbor.DecOptions{
+		// Match what encoding/json gives us, so that the rest of the
+		// server doesn't need to care which codec a guest uses.
+		DefaultMapType: reflect.TypeOf(map[string]interface{}{}),
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return dm
+}()
+
+var cborEncMode = func() cbor.EncMode {
+	em, err := cbor.EncOptions{
+		// Positions are mostly small, round-ish numbers.
+		ShortestFloat: cbor.ShortestFloat16,
+	}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return em
+}()
+
+type cborCodec struct{}
+
+func (cborCodec) Subprotocol() string                        { return "space.cbor" }
+func (cborCodec) MessageType() int                           { return websocket.BinaryMessage }
+func (cborCodec) Marshal(v interface{}) ([]byte, error)      { return cborEncMode.Marshal(v) }
+func (cborCodec) Unmarshal(data []byte, v interface{}) error { return cborDecMode.Unmarshal(data, v) }
+
+var (
+	JSON Codec = jsonCodec{}
+	CBOR Codec = cborCodec{}
+)
+
+var codecs = []Codec{CBOR, JSON}
+
+// Subprotocols lists the subprotocols to offer when upgrading a guest's
+// WebSocket.
+func Subprotocols() []string {
+	ret := []string{}
+	for _, c := range codecs {
+		if c.Subprotocol() != "" {
+			ret = append(ret, c.Subprotocol())
+		}
+	}
+	return ret
+}
+
+func codecFor(conn *websocket.Conn) Codec {
+	for _, c := range codecs {
+		if c.Subprotocol() == conn.Subprotocol() {
+			return c
+		}
+	}
+	return JSON
+}
+
+func writeMessage(conn *websocket.Conn, codec Codec, msg interface{}) error {
+	data, err := codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(codec.MessageType(), data)
+}
+
+// Body is the body of an incoming message, left encoded until its handler
+// knows what to decode it into.
+type Body struct {
+	data  []byte
+	codec Codec
+}
+
+func (b Body) Decode(v interface{}) error {
+	if b.codec == nil {
+		return JSON.Unmarshal([]byte("null"), v)
+	}
+	return b.codec.Unmarshal(b.data, v)
+}
+
+// Size is the encoded size of the body, in bytes.
+func (b Body) Size() int {
+	return len(b.data)
+}
+
+func (b *Body) UnmarshalJSON(data []byte) error {
+	b.data = append([]byte(nil), data...)
+	b.codec = JSON
+	return nil
+}
+
+func (b *Body) UnmarshalCBOR(data []byte) error {
+	b.data = append([]byte(nil), data...)
+	b.codec = CBOR
+	return nil
+}
+
+func (b Body) marshal(codec Codec) ([]byte, error) {
+	if b.codec == codec {
+		return b.data, nil
+	}
+	var v interface{}
+	if err := b.Decode(&v); err != nil {
+		return nil, err
+	}
+	return codec.Marshal(v)
+}
+
+// Bodies can be passed along as-is, like when the management page broadcasts
+// a message, and get re-encoded if the recipient uses a different codec.
+func (b Body) MarshalJSON() ([]byte, error) { return b.marshal(JSON) }
+func (b Body) MarshalCBOR() ([]byte, error) { return b.marshal(CBOR) }
+
+type IncomingMessage struct {
+	Type string `json:"type"`
+	Body Body   `json:"body"`
+}
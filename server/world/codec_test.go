@@ -0,0 +1,38 @@
+package world
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// A guest's state as clients send it, moving around with a few extras.
+const sampleGuestState = `{
+	"position": [3.2761538028717043, -7.914285659790039, 0.23000000417232513],
+	"look": [0.7853981633974483, -0.1],
+	"role": "",
+	"name": "guest",
+	"color": "#ff8800",
+	"dancing": true
+}`
+
+func benchmarkEncode(b *testing.B, codec Codec) {
+	var state GuestPublic
+	if err := json.Unmarshal([]byte(sampleGuestState), &state); err != nil {
+		b.Fatal(err)
+	}
+	msg := MakeGuestUpdateMessage(42, &Guest{Public: state})
+	b.ReportAllocs()
+	b.ResetTimer()
+	var size int
+	for i := 0; i < b.N; i++ {
+		data, err := codec.Marshal(msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size = len(data)
+	}
+	b.ReportMetric(float64(size), "bytes/msg")
+}
+
+func BenchmarkEncodeJSON(b *testing.B) { benchmarkEncode(b, JSON) }
+func BenchmarkEncodeCBOR(b *testing.B) { benchmarkEncode(b, CBOR) }
@@ -0,0 +1,158 @@
+package world
+
+import "math"
+
+// Guests already in range of each other only drop out of range once they're
+// this much farther apart than InterestRadius, so that someone standing right
+// on the boundary doesn't flicker in and out.
+const interestHysteresis = 1.1
+
+type cell [2]int64
+
+// interestGrid is a uniform grid over guest positions (on the ground plane)
+// plus the set of pairs of guests that currently know about each other.
+// Guests without a valid position are "everywhere": they're near everyone.
+type interestGrid struct {
+	cellSize  float64
+	cells     map[cell]map[uint32]bool
+	positions map[uint32]Vec3
+	unplaced  map[uint32]bool
+	neighbors map[uint32]map[uint32]bool
+}
+
+func (g *Guest) position() (Vec3, bool) {
+	var ret Vec3
+	pos, ok := g.Public["position"].([]interface{})
+	if !ok || len(pos) != len(ret) {
+		return ret, false
+	}
+	for i, v := range pos {
+		if !isFinite(v) {
+			return ret, false
+		}
+		ret[i], _ = toFloat(v)
+	}
+	return ret, true
+}
+
+// Distance returns how far apart two guests are, if both have a position.
+func (w *World) Distance(a, b uint32) (float64, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	ga, ok := w.Guests[a]
+	if !ok {
+		return 0, false
+	}
+	gb, ok := w.Guests[b]
+	if !ok {
+		return 0, false
+	}
+	posA, okA := ga.position()
+	posB, okB := gb.position()
+	if !okA || !okB {
+		return 0, false
+	}
+	return posA.distance(posB), true
+}
+
+func (v Vec3) distance(o Vec3) float64 {
+	var sum float64
+	for i := range v {
+		sum += (v[i] - o[i]) * (v[i] - o[i])
+	}
+	return math.Sqrt(sum)
+}
+
+func (ig *interestGrid) cellFor(pos Vec3) cell {
+	return cell{
+		int64(math.Floor(pos[0] / ig.cellSize)),
+		int64(math.Floor(pos[1] / ig.cellSize)),
+	}
+}
+
+func (ig *interestGrid) move(seq uint32, pos Vec3, ok bool) {
+	if ig.cells == nil {
+		ig.cells = map[cell]map[uint32]bool{}
+		ig.positions = map[uint32]Vec3{}
+		ig.unplaced = map[uint32]bool{}
+		ig.neighbors = map[uint32]map[uint32]bool{}
+	}
+	if oldPos, wasPlaced := ig.positions[seq]; wasPlaced {
+		c := ig.cellFor(oldPos)
+		delete(ig.cells[c], seq)
+		if len(ig.cells[c]) == 0 {
+			delete(ig.cells, c)
+		}
+		delete(ig.positions, seq)
+	}
+	delete(ig.unplaced, seq)
+	if !ok {
+		ig.unplaced[seq] = true
+		return
+	}
+	c := ig.cellFor(pos)
+	if ig.cells[c] == nil {
+		ig.cells[c] = map[uint32]bool{}
+	}
+	ig.cells[c][seq] = true
+	ig.positions[seq] = pos
+}
+
+func (ig *interestGrid) remove(seq uint32) {
+	ig.move(seq, Vec3{}, false)
+	delete(ig.unplaced, seq)
+	for k := range ig.neighbors[seq] {
+		delete(ig.neighbors[k], seq)
+	}
+	delete(ig.neighbors, seq)
+}
+
+func (ig *interestGrid) link(a, b uint32, linked bool) {
+	for _, pair := range [][2]uint32{{a, b}, {b, a}} {
+		if linked {
+			if ig.neighbors[pair[0]] == nil {
+				ig.neighbors[pair[0]] = map[uint32]bool{}
+			}
+			ig.neighbors[pair[0]][pair[1]] = true
+		} else {
+			delete(ig.neighbors[pair[0]], pair[1])
+		}
+	}
+}
+
+// near returns the guests within radius of seq, which must already be in the
+// grid. Guests which are already neighbors of seq are kept a bit longer, see
+// interestHysteresis.
+func (ig *interestGrid) near(seq uint32, radius float64, all map[uint32]*Guest) map[uint32]bool {
+	ret := map[uint32]bool{}
+	pos, ok := ig.positions[seq]
+	if !ok {
+		for k := range all {
+			if k != seq {
+				ret[k] = true
+			}
+		}
+		return ret
+	}
+	for k := range ig.unplaced {
+		ret[k] = true
+	}
+	for k := range ig.neighbors[seq] {
+		if otherPos, ok := ig.positions[k]; ok && pos.distance(otherPos) <= radius*interestHysteresis {
+			ret[k] = true
+		}
+	}
+	span := int64(math.Ceil(radius / ig.cellSize))
+	center := ig.cellFor(pos)
+	for x := center[0] - span; x <= center[0]+span; x++ {
+		for y := center[1] - span; y <= center[1]+span; y++ {
+			for k := range ig.cells[cell{x, y}] {
+				if k != seq && pos.distance(ig.positions[k]) <= radius {
+					ret[k] = true
+				}
+			}
+		}
+	}
+	delete(ret, seq)
+	return ret
+}
@@ -0,0 +1,158 @@
+package world
+
+import (
+	"fmt"
+	"math"
+)
+
+// GuestPublicLimits bounds what guests can put in their GuestPublic. Zero
+// fields fall back to the defaults below.
+type GuestPublicLimits struct {
+	MaxSize         int `json:"maxSize"`
+	MaxKeys         int `json:"maxKeys"`
+	MaxDepth        int `json:"maxDepth"`
+	MaxStringLength int `json:"maxStringLength"`
+
+	// If set, only these keys are allowed, and their values must have the
+	// given type: "string", "number", "bool", "vec2", "vec3", "array",
+	// "object" or "any".
+	Schema map[string]string `json:"schema,omitempty"`
+}
+
+const (
+	defaultMaxSize         = 16384
+	defaultMaxKeys         = 64
+	defaultMaxDepth        = 8
+	defaultMaxStringLength = 1024
+)
+
+func orDefault(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+// Parse decodes a guest's public state and checks it against the limits. Keys
+// in omit aren't part of the state (e.g. options that come along with it) and
+// are dropped before checking.
+func (l *GuestPublicLimits) Parse(body Body, omit ...string) (GuestPublic, error) {
+	if maxSize := orDefault(l.MaxSize, defaultMaxSize); body.Size() > maxSize {
+		return nil, fmt.Errorf("state is %d bytes, more than the limit of %d", body.Size(), maxSize)
+	}
+	var state GuestPublic
+	if err := body.Decode(&state); err != nil {
+		return nil, err
+	}
+	for _, k := range omit {
+		delete(state, k)
+	}
+	if maxKeys := orDefault(l.MaxKeys, defaultMaxKeys); len(state) > maxKeys {
+		return nil, fmt.Errorf("state has %d keys, more than the limit of %d", len(state), maxKeys)
+	}
+	maxLength := orDefault(l.MaxStringLength, defaultMaxStringLength)
+	for k, v := range state {
+		if len(k) > maxLength {
+			return nil, fmt.Errorf("key is %d bytes, more than the limit of %d", len(k), maxLength)
+		}
+		if err := l.checkValue(v, 2); err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+		if l.Schema == nil {
+			continue
+		}
+		t, ok := l.Schema[k]
+		if !ok {
+			return nil, fmt.Errorf("%s: key not allowed", k)
+		}
+		if !hasType(v, t) {
+			return nil, fmt.Errorf("%s: expected %s", k, t)
+		}
+	}
+	return state, nil
+}
+
+func (l *GuestPublicLimits) checkValue(v interface{}, depth int) error {
+	if maxDepth := orDefault(l.MaxDepth, defaultMaxDepth); depth > maxDepth {
+		return fmt.Errorf("nested more than %d deep", maxDepth)
+	}
+	switch v := v.(type) {
+	case string:
+		if maxLength := orDefault(l.MaxStringLength, defaultMaxStringLength); len(v) > maxLength {
+			return fmt.Errorf("string is %d bytes, more than the limit of %d", len(v), maxLength)
+		}
+	case []interface{}:
+		for _, e := range v {
+			if err := l.checkValue(e, depth+1); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		if maxKeys := orDefault(l.MaxKeys, defaultMaxKeys); len(v) > maxKeys {
+			return fmt.Errorf("object has %d keys, more than the limit of %d", len(v), maxKeys)
+		}
+		for k, e := range v {
+			if maxLength := orDefault(l.MaxStringLength, defaultMaxStringLength); len(k) > maxLength {
+				return fmt.Errorf("key is %d bytes, more than the limit of %d", len(k), maxLength)
+			}
+			if err := l.checkValue(e, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// toFloat accepts any number, since binary codecs can decode integers to
+// integer types.
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func isFinite(v interface{}) bool {
+	f, ok := toFloat(v)
+	return ok && !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+func hasType(v interface{}, t string) bool {
+	switch t {
+	case "any":
+		return true
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		return isFinite(v)
+	case "bool":
+		_, ok := v.(bool)
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "vec2", "vec3":
+		a, ok := v.([]interface{})
+		if !ok || (t == "vec2" && len(a) != 2) || (t == "vec3" && len(a) != 3) {
+			return false
+		}
+		for _, e := range a {
+			if !isFinite(e) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
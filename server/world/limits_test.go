@@ -0,0 +1,30 @@
+package world
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLimitsLongKeys(t *testing.T) {
+	l := &GuestPublicLimits{MaxStringLength: 8}
+	for _, state := range []string{
+		`{"` + strings.Repeat("k", 9) + `": 1}`,
+		`{"nested": {"` + strings.Repeat("k", 9) + `": 1}}`,
+	} {
+		var body Body
+		if err := json.Unmarshal([]byte(state), &body); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.Parse(body); err == nil {
+			t.Errorf("accepted %s", state)
+		}
+	}
+	var body Body
+	if err := json.Unmarshal([]byte(`{"position": [1, 2, 3]}`), &body); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Parse(body); err != nil {
+		t.Error(err)
+	}
+}
@@ -2,10 +2,14 @@ package world
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/s4y/space/util"
@@ -14,22 +18,31 @@ import (
 type Vec2 [2]float64
 type Vec3 [3]float64
 
-// Warning: there's currently no limit on the size of this object.
+// Guests can put anything in here, within GuestPublicLimits.
 type GuestPublic map[string]interface{}
 
 type Guest struct {
 	Public    GuestPublic
 	IPAddr    string
 	DebugInfo sync.Map
+	conn      *websocket.Conn
+	codec     Codec
 	read      chan interface{}
 	write     chan interface{}
 	ctx       context.Context
 	cancel    context.CancelFunc
+
+	resumeToken string
+	expire      *time.Timer
+	kicked      int32
+	speaking    bool
 }
 
 func MakeGuest(ctx context.Context, conn *websocket.Conn) *Guest {
 	childCtx, cancel := context.WithCancel(ctx)
 	guest := &Guest{
+		conn:   conn,
+		codec:  codecFor(conn),
 		read:   make(chan interface{}),
 		write:  make(chan interface{}, 100),
 		ctx:    childCtx,
@@ -38,7 +51,7 @@ func MakeGuest(ctx context.Context, conn *websocket.Conn) *Guest {
 
 	go func() {
 		for msg := range guest.read {
-			conn.WriteJSON(msg)
+			writeMessage(conn, guest.codec, msg)
 		}
 	}()
 
@@ -48,7 +61,7 @@ func MakeGuest(ctx context.Context, conn *websocket.Conn) *Guest {
 				f()
 				return
 			}
-			conn.WriteJSON(msg)
+			writeMessage(conn, guest.codec, msg)
 		}
 	}()
 
@@ -70,6 +83,15 @@ func (g *Guest) Read(msg interface{}) (interface{}, error) {
 	}
 }
 
+// ReadMessage reads the next message from the guest's WebSocket.
+func (g *Guest) ReadMessage(msg *IncomingMessage) error {
+	_, data, err := g.conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return g.codec.Unmarshal(data, msg)
+}
+
 func (g *Guest) Write(msg interface{}) error {
 	select {
 	case <-g.ctx.Done():
@@ -83,6 +105,7 @@ func (g *Guest) Write(msg interface{}) error {
 }
 
 func (g *Guest) Kick(kind string) {
+	atomic.StoreInt32(&g.kicked, 1)
 	g.Write(MakeClientMessage("kick", struct {
 		Kind string `json:"kind"`
 	}{kind}))
@@ -91,31 +114,66 @@ func (g *Guest) Kick(kind string) {
 	})
 }
 
-type WorldEventType int
+// A GuestEvent says that a guest joined or changed.
+type GuestEvent struct {
+	Seq   uint32
+	Guest *Guest
+}
 
-const (
-	WorldEventGuestJoined WorldEventType = iota
-	WorldEventGuestUpdated
-	WorldEventGuestDebug
-	WorldEventGuestLeft
-)
+// A GuestDebug says that a guest's debug info changed.
+type GuestDebug struct {
+	Seq   uint32
+	Key   string
+	Value interface{}
+}
 
-type World struct {
-	observers util.Observers
+// A GuestSpeaking says that a guest started or stopped talking.
+type GuestSpeaking struct {
+	Seq      uint32 `json:"id"`
+	Speaking bool   `json:"speaking"`
+}
 
-	mutex  sync.Mutex
-	seq    uint32
-	Guests map[uint32]*Guest `json:"guests"`
+type World struct {
+	guestJoined   util.Observers[GuestEvent]
+	guestUpdated  util.Observers[GuestEvent]
+	guestDebug    util.Observers[GuestDebug]
+	guestSpeaking util.Observers[GuestSpeaking]
+	guestLeft     util.Observers[uint32]
+
+	// When InterestRadius is nonzero, guests only hear about guests within
+	// that distance of them. InterestCellSize is the size of the grid used
+	// to find them, and defaults to InterestRadius.
+	InterestRadius   float64
+	InterestCellSize float64
+
+	// Guests whose connection drops can resume within ResumeGrace, see
+	// Resume. Zero removes them right away.
+	ResumeGrace time.Duration
+
+	// Guest updates are batched and sent every TickInterval, see Run. Zero
+	// sends them right away.
+	TickInterval time.Duration
+
+	mutex    sync.Mutex
+	seq      uint32
+	Guests   map[uint32]*Guest `json:"guests"`
+	interest interestGrid
+	// The last state other guests were sent for each guest that changed
+	// since the last tick.
+	dirty map[uint32]GuestPublic
+
+	resumeTokens map[string]uint32
 }
 
+// ClientMessage is a message to a client. The body is encoded with the rest of
+// the message, using whichever codec the client asked for.
 type ClientMessage struct {
-	Type string          `json:"type"`
-	Body json.RawMessage `json:"body"`
+	Type string      `json:"type"`
+	Body interface{} `json:"body"`
 }
 
 func MakeClientMessage(t string, message interface{}) ClientMessage {
-	body, _ := json.Marshal(message)
-	return ClientMessage{t, body}
+	return ClientMessage{t, message}
 }
 
 func MakeGuestUpdateMessage(id uint32, guest *Guest) interface{} {
@@ -125,6 +183,48 @@ func MakeGuestUpdateMessage(id uint32, guest *Guest) interface{} {
 	}{id, guest.Public})
 }
 
+type guestSnapshot struct {
+	Id    uint32      `json:"id"`
+	State GuestPublic `json:"state"`
+}
+
+type guestDelta struct {
+	Id      uint32      `json:"id"`
+	Changed GuestPublic `json:"changed,omitempty"`
+	Removed []string    `json:"removed,omitempty"`
+}
+
+// makeGuestDelta describes the keys that differ between two versions of a
+// guest's public state, or returns nil if there aren't any.
+func makeGuestDelta(id uint32, prev, next GuestPublic) *guestDelta {
+	delta := &guestDelta{Id: id, Changed: GuestPublic{}}
+	for k, v := range next {
+		if prevV, ok := prev[k]; !ok || !reflect.DeepEqual(prevV, v) {
+			delta.Changed[k] = v
+		}
+	}
+	for k := range prev {
+		if _, ok := next[k]; !ok {
+			delta.Removed = append(delta.Removed, k)
+		}
+	}
+	if len(delta.Changed) == 0 && len(delta.Removed) == 0 {
+		return nil
+	}
+	return delta
+}
+
+func makeGuestLeavingMessage(id uint32, outOfRange bool) interface{} {
+	return MakeClientMessage("guestLeaving", struct {
+		Id         uint32 `json:"id"`
+		OutOfRange bool   `json:"outOfRange,omitempty"`
+	}{id, outOfRange})
+}
+
+func makeSpeakingMessage(id uint32, speaking bool) interface{} {
+	return MakeClientMessage("speaking", GuestSpeaking{id, speaking})
+}
+
 func (w *World) broadcast(m interface{}, skip uint32) {
 	for k, v := range w.Guests {
 		if k == skip {
@@ -136,33 +236,119 @@ func (w *World) broadcast(m interface{}, skip uint32) {
 
 func (w *World) join(seq uint32, g *Guest) {
 	g.Write(MakeClientMessage("hello", struct {
-		Seq uint32 `json:"seq"`
-	}{seq}))
+		Seq         uint32 `json:"seq"`
+		ResumeToken string `json:"resumeToken,omitempty"`
+	}{seq, g.resumeToken}))
 
 	for k, v := range w.Guests {
 		if v == g {
 			continue
 		}
+		if w.InterestRadius > 0 && !w.interest.neighbors[seq][k] {
+			continue
+		}
 		g.Write(MakeGuestUpdateMessage(k, v))
+		if v.speaking {
+			g.Write(makeSpeakingMessage(k, true))
+		}
 	}
 }
 
-func (w *World) sendDebug(seq uint32, o func(uint32, string, interface{})) {
-	g := w.Guests[seq]
+// placeInterest moves seq to where it is now in the interest grid.
+func (w *World) placeInterest(seq uint32) {
+	if w.interest.cellSize == 0 {
+		w.interest.cellSize = w.InterestCellSize
+		if w.interest.cellSize <= 0 {
+			w.interest.cellSize = w.InterestRadius
+		}
+	}
+	pos, ok := w.Guests[seq].position()
+	w.interest.move(seq, pos, ok)
+}
+
+// relinkInterest links seq to the guests near it and unlinks it from the
+// rest, going by where everyone is in the grid. Before records what each
+// pair it changes was linked as before the first change, keyed {low, high}.
+func (w *World) relinkInterest(seq uint32, before map[[2]uint32]bool) {
+	near := w.interest.near(seq, w.InterestRadius, w.Guests)
+	change := func(k uint32, linked bool) {
+		pair := [2]uint32{seq, k}
+		if k < seq {
+			pair = [2]uint32{k, seq}
+		}
+		if _, ok := before[pair]; !ok {
+			before[pair] = !linked
+		}
+		w.interest.link(seq, k, linked)
+	}
+	for k := range w.interest.neighbors[seq] {
+		if !near[k] {
+			change(k, false)
+		}
+	}
+	for k := range near {
+		if !w.interest.neighbors[seq][k] {
+			change(k, true)
+		}
+	}
+}
+
+func sendDebug(seq uint32, g *Guest, send func(GuestDebug)) {
 	g.DebugInfo.Range(func(key, value interface{}) bool {
-		o(seq, key.(string), value)
+		send(GuestDebug{seq, key.(string), value})
 		return true
 	})
 }
 
-func (w *World) Observe(ctx context.Context, e WorldEventType, cb interface{}) {
-	w.observers.Add(ctx, e, cb)
-	switch e {
-	case WorldEventGuestDebug:
-		for seq := range w.GetGuests() {
-			w.sendDebug(seq, cb.(func(uint32, string, interface{})))
+func (w *World) ObserveGuestJoined(ctx context.Context, cb func(GuestEvent), opts ...util.Options[GuestEvent]) util.Subscription {
+	return w.guestJoined.Add(ctx, cb, opts...)
+}
+
+func (w *World) ObserveGuestUpdated(ctx context.Context, cb func(GuestEvent), opts ...util.Options[GuestEvent]) util.Subscription {
+	return w.guestUpdated.Add(ctx, cb, opts...)
+}
+
+// ObserveGuestDebug also calls cb with every guest's current debug info
+// first.
+func (w *World) ObserveGuestDebug(ctx context.Context, cb func(GuestDebug), opts ...util.Options[GuestDebug]) util.Subscription {
+	var o util.Options[GuestDebug]
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for seq, g := range w.Guests {
+		sendDebug(seq, g, func(e GuestDebug) {
+			o.Initial = append(o.Initial, e)
+		})
+	}
+	return w.guestDebug.Add(ctx, cb, o)
+}
+
+// ObserveGuestSpeaking also calls cb for every guest who's talking first.
+func (w *World) ObserveGuestSpeaking(ctx context.Context, cb func(GuestSpeaking), opts ...util.Options[GuestSpeaking]) util.Subscription {
+	var o util.Options[GuestSpeaking]
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for seq, g := range w.Guests {
+		if g.speaking {
+			o.Initial = append(o.Initial, GuestSpeaking{seq, true})
 		}
 	}
+	return w.guestSpeaking.Add(ctx, cb, o)
+}
+
+func (w *World) ObserveGuestLeft(ctx context.Context, cb func(uint32), opts ...util.Options[uint32]) util.Subscription {
+	return w.guestLeft.Add(ctx, cb, opts...)
+}
+
+// DroppedEvents returns how many events observers have missed because they
+// fell behind.
+func (w *World) DroppedEvents() uint64 {
+	return w.guestJoined.Dropped() + w.guestUpdated.Dropped() + w.guestDebug.Dropped() + w.guestSpeaking.Dropped() + w.guestLeft.Dropped()
 }
 
 func (w *World) GetGuests() map[uint32]*Guest {
@@ -184,18 +370,92 @@ func (w *World) AddGuest(ctx context.Context, g *Guest) uint32 {
 		w.Guests = map[uint32]*Guest{}
 	}
 	w.Guests[seq] = g
-	w.join(seq, g)
+	if w.ResumeGrace > 0 {
+		g.resumeToken = makeResumeToken()
+		if w.resumeTokens == nil {
+			w.resumeTokens = map[string]uint32{}
+		}
+		w.resumeTokens[g.resumeToken] = seq
+	}
+	if w.InterestRadius > 0 {
+		w.placeInterest(seq)
+		w.relinkInterest(seq, map[[2]uint32]bool{})
+		w.join(seq, g)
+		m := MakeGuestUpdateMessage(seq, g)
+		for k := range w.interest.neighbors[seq] {
+			w.Guests[k].Write(m)
+		}
+	} else {
+		w.join(seq, g)
+		w.broadcast(MakeGuestUpdateMessage(seq, g), seq)
+	}
+	w.watchGuest(ctx, seq, g)
+	w.guestJoined.Notify(GuestEvent{seq, g})
+	sendDebug(seq, g, w.guestDebug.Notify)
+	return seq
+}
+
+func makeResumeToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// watchGuest removes a guest once its connection closes, after giving it
+// ResumeGrace to come back.
+func (w *World) watchGuest(ctx context.Context, seq uint32, g *Guest) {
 	go func() {
 		<-ctx.Done()
-		w.RemoveGuest(seq)
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		if w.Guests[seq] != g {
+			return
+		}
+		if w.ResumeGrace == 0 || atomic.LoadInt32(&g.kicked) != 0 {
+			w.removeGuest(seq)
+			return
+		}
+		g.expire = time.AfterFunc(w.ResumeGrace, func() {
+			w.mutex.Lock()
+			defer w.mutex.Unlock()
+			if w.Guests[seq] == g {
+				w.removeGuest(seq)
+			}
+		})
 	}()
-	for _, o := range w.observers.Get(WorldEventGuestJoined) {
-		o.(func(uint32, *Guest))(seq, g)
+}
+
+// Resume hands an existing guest's seq and state to a new connection, if
+// token belongs to a guest who hasn't been gone longer than ResumeGrace.
+// Nobody else sees the guest leave.
+func (w *World) Resume(ctx context.Context, token string, g *Guest) (uint32, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	seq, ok := w.resumeTokens[token]
+	if !ok {
+		return 0, false
 	}
-	for _, o := range w.observers.Get(WorldEventGuestDebug) {
-		w.sendDebug(seq, o.(func(uint32, string, interface{})))
+	old := w.Guests[seq]
+	if old.expire != nil {
+		old.expire.Stop()
 	}
-	return seq
+	// The old connection may not have noticed that it's dead yet.
+	old.cancel()
+	g.Public = old.Public
+	g.speaking = old.speaking
+	old.DebugInfo.Range(func(key, value interface{}) bool {
+		g.DebugInfo.LoadOrStore(key, value)
+		return true
+	})
+	g.resumeToken = token
+	w.Guests[seq] = g
+	w.join(seq, g)
+	w.watchGuest(ctx, seq, g)
+	w.guestJoined.Notify(GuestEvent{seq, g})
+	sendDebug(seq, g, w.guestDebug.Notify)
+	return seq, true
 }
 
 func (w *World) Rejoin(seq uint32) {
@@ -210,36 +470,159 @@ func (w *World) BroadcastFrom(seq uint32, message interface{}) {
 	w.broadcast(message, seq)
 }
 
-func (w *World) UpdateGuest(seq uint32) {
+// UpdateGuest replaces a guest's public state. Other guests hear about it on
+// the next tick.
+func (w *World) UpdateGuest(seq uint32, state GuestPublic) {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 	g := w.Guests[seq]
-	w.broadcast(MakeGuestUpdateMessage(seq, g), seq)
-	for _, o := range w.observers.Get(WorldEventGuestUpdated) {
-		o.(func(uint32, *Guest))(seq, g)
+	if w.dirty == nil {
+		w.dirty = map[uint32]GuestPublic{}
+	}
+	if _, ok := w.dirty[seq]; !ok {
+		w.dirty[seq] = g.Public
+	}
+	g.Public = state
+	if w.TickInterval == 0 {
+		w.flush()
+	}
+}
+
+// Run sends out batched guest updates every TickInterval until ctx is done.
+func (w *World) Run(ctx context.Context) {
+	if w.TickInterval == 0 {
+		return
+	}
+	ticker := time.NewTicker(w.TickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.mutex.Lock()
+			w.flush()
+			w.mutex.Unlock()
+		}
 	}
 }
 
+// flush sends each guest one guestUpdates message covering every guest that
+// changed since the last flush.
+func (w *World) flush() {
+	if len(w.dirty) == 0 {
+		return
+	}
+	batches := map[uint32][]interface{}{}
+	leaving := map[uint32][]interface{}{}
+	// Guests that came into range of each other get full snapshots instead
+	// of deltas. Pairs are {recipient, subject}.
+	entered := map[[2]uint32]bool{}
+	if w.InterestRadius > 0 {
+		// Everyone moves before anyone's links are worked out, so that
+		// guests passing each other don't see each other at where the
+		// other one used to be.
+		for seq := range w.dirty {
+			w.placeInterest(seq)
+		}
+		before := map[[2]uint32]bool{}
+		for seq := range w.dirty {
+			w.relinkInterest(seq, before)
+		}
+		for pair, wasLinked := range before {
+			a, b := pair[0], pair[1]
+			if linked := w.interest.neighbors[a][b]; linked && !wasLinked {
+				entered[[2]uint32{a, b}] = true
+				entered[[2]uint32{b, a}] = true
+			} else if !linked && wasLinked {
+				leaving[a] = append(leaving[a], makeGuestLeavingMessage(b, true))
+				leaving[b] = append(leaving[b], makeGuestLeavingMessage(a, true))
+			}
+		}
+		for pair := range entered {
+			batches[pair[0]] = append(batches[pair[0]], guestSnapshot{pair[1], w.Guests[pair[1]].Public})
+		}
+	}
+	for seq, prev := range w.dirty {
+		g := w.Guests[seq]
+		delta := makeGuestDelta(seq, prev, g.Public)
+		if delta == nil {
+			continue
+		}
+		for k := range w.Guests {
+			if k == seq || entered[[2]uint32{k, seq}] {
+				continue
+			}
+			if w.InterestRadius > 0 && !w.interest.neighbors[seq][k] {
+				continue
+			}
+			batches[k] = append(batches[k], delta)
+		}
+		w.guestUpdated.Notify(GuestEvent{seq, g})
+	}
+	w.dirty = nil
+	for k, msgs := range leaving {
+		for _, m := range msgs {
+			w.Guests[k].Write(m)
+		}
+	}
+	for k, batch := range batches {
+		w.Guests[k].Write(MakeClientMessage("guestUpdates", batch))
+	}
+}
+
+// SetSpeaking tells everyone who can see a guest, including the guest, when
+// it starts or stops talking.
+func (w *World) SetSpeaking(seq uint32, speaking bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	g, ok := w.Guests[seq]
+	if !ok || g.speaking == speaking {
+		return
+	}
+	g.speaking = speaking
+	m := makeSpeakingMessage(seq, speaking)
+	if w.InterestRadius > 0 {
+		g.Write(m)
+		for k := range w.interest.neighbors[seq] {
+			w.Guests[k].Write(m)
+		}
+	} else {
+		w.broadcast(m, 0)
+	}
+	w.guestSpeaking.Notify(GuestSpeaking{seq, speaking})
+}
+
 func (w *World) SetGuestDebug(seq uint32, key string, value interface{}) {
 	w.mutex.Lock()
-	g := w.Guests[seq]
 	defer w.mutex.Unlock()
-	g.DebugInfo.Store(key, value)
-	for _, o := range w.observers.Get(WorldEventGuestDebug) {
-		o.(func(uint32, string, interface{}))(seq, key, value)
+	g, ok := w.Guests[seq]
+	if !ok {
+		return
 	}
+	g.DebugInfo.Store(key, value)
+	w.guestDebug.Notify(GuestDebug{seq, key, value})
 }
 
 func (w *World) RemoveGuest(seq uint32) {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
-	w.broadcast(MakeClientMessage(
-		"guestLeaving",
-		struct {
-			Id uint32 `json:"id"`
-		}{seq}), seq)
-	delete(w.Guests, seq)
-	for _, o := range w.observers.Get(WorldEventGuestLeft) {
-		o.(func(uint32))(seq)
+	w.removeGuest(seq)
+}
+
+func (w *World) removeGuest(seq uint32) {
+	if g, ok := w.Guests[seq]; ok {
+		delete(w.resumeTokens, g.resumeToken)
 	}
+	if w.InterestRadius > 0 {
+		for k := range w.interest.neighbors[seq] {
+			w.Guests[k].Write(makeGuestLeavingMessage(seq, false))
+		}
+		w.interest.remove(seq)
+	} else {
+		w.broadcast(makeGuestLeavingMessage(seq, false), seq)
+	}
+	delete(w.Guests, seq)
+	delete(w.dirty, seq)
+	w.guestLeft.Notify(seq)
 }
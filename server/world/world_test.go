@@ -0,0 +1,82 @@
+package world
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testGuest(x float64) *Guest {
+	return &Guest{
+		Public: GuestPublic{"position": []interface{}{x, 0.0, 0.0}},
+		write:  make(chan interface{}, 100),
+		ctx:    context.Background(),
+	}
+}
+
+func drain(g *Guest) []interface{} {
+	var ret []interface{}
+	for {
+		select {
+		case msg := <-g.write:
+			ret = append(ret, msg)
+		default:
+			return ret
+		}
+	}
+}
+
+func TestInterestGuestsPassing(t *testing.T) {
+	// A moves to where B was while B moves away. Whichever of them the
+	// flush looks at first, A shouldn't hear about B.
+	for i := 0; i < 50; i++ {
+		w := &World{InterestRadius: 10, TickInterval: time.Hour}
+		w.Guests = map[uint32]*Guest{1: testGuest(0), 2: testGuest(100)}
+		for seq := range w.Guests {
+			w.placeInterest(seq)
+		}
+		for seq := range w.Guests {
+			w.relinkInterest(seq, map[[2]uint32]bool{})
+		}
+		w.UpdateGuest(1, GuestPublic{"position": []interface{}{95.0, 0.0, 0.0}})
+		w.UpdateGuest(2, GuestPublic{"position": []interface{}{200.0, 0.0, 0.0}})
+		w.mutex.Lock()
+		w.flush()
+		w.mutex.Unlock()
+		if msgs := drain(w.Guests[1]); len(msgs) != 0 {
+			t.Fatalf("A got %s", fmt.Sprint(msgs))
+		}
+	}
+}
+
+func TestInterestEnterAndLeave(t *testing.T) {
+	w := &World{InterestRadius: 10, TickInterval: time.Hour}
+	w.Guests = map[uint32]*Guest{1: testGuest(0), 2: testGuest(100)}
+	for seq := range w.Guests {
+		w.placeInterest(seq)
+	}
+	tick := func(x1, x2 float64) {
+		w.UpdateGuest(1, GuestPublic{"position": []interface{}{x1, 0.0, 0.0}})
+		w.UpdateGuest(2, GuestPublic{"position": []interface{}{x2, 0.0, 0.0}})
+		w.mutex.Lock()
+		w.flush()
+		w.mutex.Unlock()
+	}
+
+	tick(50, 55)
+	msgs := drain(w.Guests[1])
+	if len(msgs) != 1 {
+		t.Fatalf("A got %v coming into range", msgs)
+	}
+	batch := msgs[0].(ClientMessage).Body.([]interface{})
+	if snapshot, ok := batch[0].(guestSnapshot); !ok || snapshot.Id != 2 {
+		t.Errorf("A got %v coming into range, want a snapshot of B", batch)
+	}
+
+	tick(0, 100)
+	msgs = drain(w.Guests[1])
+	if len(msgs) != 1 || fmt.Sprint(msgs[0]) != fmt.Sprint(makeGuestLeavingMessage(2, true)) {
+		t.Errorf("A got %v going out of range", msgs)
+	}
+}
@@ -12,8 +12,22 @@ export default class RTCPeer {
     this.close();
     this.pc = pc;
 
-    pc.onnegotiationneeded = e => {
-      this.sendToPeer(['renegotiate', null]);
+    pc.onnegotiationneeded = async e => {
+      // Simulcast can only be set up by whoever makes the offer.
+      if (!this.simulcast) {
+        this.sendToPeer(['renegotiate', null]);
+        return;
+      }
+      try {
+        await pc.setLocalDescription(await pc.createOffer());
+      } catch (e) {
+        if (this.onerror)
+          this.onerror(e);
+        else
+          throw e;
+        return;
+      }
+      this.sendToPeer(['offer', pc.localDescription]);
     };
 
     pc.onicecandidate = (e) => {
@@ -51,6 +65,12 @@ export default class RTCPeer {
       }
       if (existingSender)
         existingSender.replaceTrack(track);
+      else if (this.simulcast && track.kind == 'video')
+        this.pc.addTransceiver(track, {
+          direction: 'sendonly',
+          streams: [this.mediaStream],
+          sendEncodings: this.simulcast,
+        });
       else
         this.pc.addTrack(track, this.mediaStream);
     }
@@ -72,6 +92,8 @@ export default class RTCPeer {
   async receiveFromPeer([name, value]) {
     const {pc} = this;
     if (name == 'offer') {
+      // If we offered at the same time, setRemoteDescription rolls ours
+      // back, and we offer again once this is done.
       try {
         await pc.setRemoteDescription(value)
         const answer = await pc.createAnswer(pc.remoteDescription);
@@ -86,6 +108,15 @@ export default class RTCPeer {
         return;
       }
       this.sendToPeer(['answer', pc.localDescription]);
+    } else if (name == 'answer') {
+      try {
+        await pc.setRemoteDescription(value);
+      } catch (e) {
+        if (this.onerror)
+          this.onerror(e);
+        else
+          throw e;
+      }
     } else if (name == 'map') {
       this.midMap = value;
     } else if (name == 'icecandidate') {
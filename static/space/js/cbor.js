@@ -0,0 +1,284 @@
+// Just enough CBOR (RFC 8949) to talk to the server, which speaks it to
+// clients that ask for the space.cbor WebSocket subprotocol. Values come out
+// the way JSON.parse would make them, and go in the way JSON.stringify would
+// take them, toJSON and all.
+
+const textEncoder = new TextEncoder();
+const textDecoder = new TextDecoder();
+
+class Writer {
+  constructor() {
+    this.buf = new Uint8Array(256);
+    this.view = new DataView(this.buf.buffer);
+    this.length = 0;
+  }
+  reserve(n) {
+    if (this.length + n <= this.buf.length)
+      return;
+    let size = this.buf.length * 2;
+    while (size < this.length + n)
+      size *= 2;
+    const buf = new Uint8Array(size);
+    buf.set(this.buf);
+    this.buf = buf;
+    this.view = new DataView(buf.buffer);
+  }
+  byte(b) {
+    this.reserve(1);
+    this.buf[this.length++] = b;
+  }
+  head(major, n) {
+    major <<= 5;
+    if (n < 24) {
+      this.byte(major | n);
+    } else if (n < 0x100) {
+      this.byte(major | 24);
+      this.byte(n);
+    } else if (n < 0x10000) {
+      this.byte(major | 25);
+      this.reserve(2);
+      this.view.setUint16(this.length, n);
+      this.length += 2;
+    } else if (n < 0x100000000) {
+      this.byte(major | 26);
+      this.reserve(4);
+      this.view.setUint32(this.length, n);
+      this.length += 4;
+    } else {
+      this.byte(major | 27);
+      this.reserve(8);
+      this.view.setBigUint64(this.length, BigInt(n));
+      this.length += 8;
+    }
+  }
+  bytes(bytes) {
+    this.reserve(bytes.length);
+    this.buf.set(bytes, this.length);
+    this.length += bytes.length;
+  }
+  number(n) {
+    if (Number.isSafeInteger(n) && !Object.is(n, -0)) {
+      if (n >= 0)
+        this.head(0, n);
+      else
+        this.head(1, -1 - n);
+    } else if (!Number.isFinite(n)) {
+      // Like JSON.stringify.
+      this.byte(0xf6);
+    } else if (Math.fround(n) == n) {
+      this.byte(0xfa);
+      this.reserve(4);
+      this.view.setFloat32(this.length, n);
+      this.length += 4;
+    } else {
+      this.byte(0xfb);
+      this.reserve(8);
+      this.view.setFloat64(this.length, n);
+      this.length += 8;
+    }
+  }
+  value(v) {
+    if (v && typeof v.toJSON == 'function')
+      v = v.toJSON();
+    switch (typeof v) {
+      case 'number':
+        this.number(v);
+        return;
+      case 'string': {
+        const bytes = textEncoder.encode(v);
+        this.head(3, bytes.length);
+        this.bytes(bytes);
+        return;
+      }
+      case 'boolean':
+        this.byte(v ? 0xf5 : 0xf4);
+        return;
+      case 'object':
+        break;
+      default:
+        // undefined and functions are skipped in objects, and null in
+        // arrays, same as JSON.
+        this.byte(0xf6);
+        return;
+    }
+    if (v === null) {
+      this.byte(0xf6);
+    } else if (v instanceof Uint8Array) {
+      this.head(2, v.length);
+      this.bytes(v);
+    } else if (Array.isArray(v)) {
+      this.head(4, v.length);
+      for (const item of v)
+        this.value(item);
+    } else {
+      const keys = Object.keys(v).filter(k => {
+        const t = typeof v[k];
+        return t != 'undefined' && t != 'function' && t != 'symbol';
+      });
+      this.head(5, keys.length);
+      for (const k of keys) {
+        this.value(k);
+        this.value(v[k]);
+      }
+    }
+  }
+}
+
+export function encode(value) {
+  const w = new Writer();
+  w.value(value);
+  return w.buf.subarray(0, w.length);
+}
+
+const BREAK = Symbol('break');
+
+class Reader {
+  constructor(buf) {
+    this.buf = buf instanceof Uint8Array ? buf : new Uint8Array(buf);
+    this.view = new DataView(this.buf.buffer, this.buf.byteOffset, this.buf.byteLength);
+    this.pos = 0;
+  }
+  need(n) {
+    if (this.pos + n > this.buf.length)
+      throw new Error('cbor: unexpected end of data');
+  }
+  argument(info) {
+    if (info < 24)
+      return info;
+    let n;
+    switch (info) {
+      case 24:
+        this.need(1);
+        n = this.view.getUint8(this.pos);
+        this.pos += 1;
+        return n;
+      case 25:
+        this.need(2);
+        n = this.view.getUint16(this.pos);
+        this.pos += 2;
+        return n;
+      case 26:
+        this.need(4);
+        n = this.view.getUint32(this.pos);
+        this.pos += 4;
+        return n;
+      case 27:
+        this.need(8);
+        n = Number(this.view.getBigUint64(this.pos));
+        this.pos += 8;
+        return n;
+      case 31:
+        return -1;
+    }
+    throw new Error(`cbor: bad additional info ${info}`);
+  }
+  float16() {
+    this.need(2);
+    const h = this.view.getUint16(this.pos);
+    this.pos += 2;
+    const sign = h & 0x8000 ? -1 : 1;
+    const exp = (h >> 10) & 0x1f;
+    const frac = h & 0x3ff;
+    if (exp == 0)
+      return sign * frac * 2 ** -24;
+    if (exp == 0x1f)
+      return frac ? NaN : sign * Infinity;
+    return sign * (1 + frac / 1024) * 2 ** (exp - 15);
+  }
+  chunks(major, len) {
+    if (len >= 0) {
+      this.need(len);
+      const bytes = this.buf.subarray(this.pos, this.pos + len);
+      this.pos += len;
+      return bytes;
+    }
+    const parts = [];
+    for (;;) {
+      const part = this.value();
+      if (part === BREAK)
+        break;
+      parts.push(major == 3 ? textEncoder.encode(part) : part);
+    }
+    const bytes = new Uint8Array(parts.reduce((n, p) => n + p.length, 0));
+    let i = 0;
+    for (const p of parts) {
+      bytes.set(p, i);
+      i += p.length;
+    }
+    return bytes;
+  }
+  value() {
+    this.need(1);
+    const initial = this.buf[this.pos++];
+    const major = initial >> 5;
+    const info = initial & 0x1f;
+    if (major == 7) {
+      switch (info) {
+        case 20: return false;
+        case 21: return true;
+        case 22: return null;
+        case 23: return undefined;
+        case 25: return this.float16();
+        case 26: {
+          this.need(4);
+          const f = this.view.getFloat32(this.pos);
+          this.pos += 4;
+          return f;
+        }
+        case 27: {
+          this.need(8);
+          const f = this.view.getFloat64(this.pos);
+          this.pos += 8;
+          return f;
+        }
+        case 31: return BREAK;
+      }
+      if (info < 24)
+        return undefined;
+      this.argument(info);
+      return undefined;
+    }
+    const n = this.argument(info);
+    switch (major) {
+      case 0:
+        return n;
+      case 1:
+        return -1 - n;
+      case 2:
+        return this.chunks(major, n).slice();
+      case 3:
+        return textDecoder.decode(this.chunks(major, n));
+      case 4: {
+        const ret = [];
+        for (let i = 0; n < 0 || i < n; i++) {
+          const item = this.value();
+          if (item === BREAK)
+            break;
+          ret.push(item);
+        }
+        return ret;
+      }
+      case 5: {
+        const ret = {};
+        for (let i = 0; n < 0 || i < n; i++) {
+          const k = this.value();
+          if (k === BREAK)
+            break;
+          ret[k] = this.value();
+        }
+        return ret;
+      }
+      case 6:
+        // Tags don't mean anything to us; just take what they're on.
+        return this.value();
+    }
+  }
+}
+
+export function decode(buf) {
+  const r = new Reader(buf);
+  const ret = r.value();
+  if (ret === BREAK)
+    throw new Error('cbor: unexpected break');
+  return ret;
+}
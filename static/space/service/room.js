@@ -148,9 +148,10 @@ class Room {
   setWs(ws) {
     this.ws = ws;
     ws.observe('open', () => {
+      // Picks up where we left off if this is a reconnect.
       ws.send({
         type: "join",
-        body: this.player,
+        body: { ...this.player.toJSON(), resumeToken: this.resumeToken },
       });
     });
     ws.observe('close', () => {
@@ -158,14 +159,33 @@ class Room {
       this.clearGuests();
     });
     ws.observe('hello', body => {
+      this.resumeToken = body.resumeToken;
       this.whoami = body;
       this.observers.fire('whoami', body);
     });
     ws.observe('guestUpdate', body => {
       this.updateGuest(body.id, body.state);
     });
+    ws.observe('guestUpdates', updates => {
+      for (const update of updates) {
+        if ('state' in update)
+          this.updateGuest(update.id, update.state);
+        else
+          this.applyGuestDelta(update);
+      }
+    });
     ws.observe('guestLeaving', body => {
-      this.removeGuest(body.id);
+      if (body.outOfRange)
+        this.hideGuest(body.id);
+      else
+        this.removeGuest(body.id);
+    });
+    ws.observe('speaking', body => {
+      const guest = this.guests[body.id];
+      if (!guest || !guest.state || guest.hidden)
+        return;
+      guest.speaking = body.speaking;
+      this.observers.fire('update', body.id, guest);
     });
     ws.observe('rtc', body => {
       if (!this.rtcPeer)
@@ -177,6 +197,12 @@ class Room {
         this.connectRTC()
       this.mapTrack(body);
     });
+    ws.observe('moderated', body => {
+      Service.get('userMedia', userMedia => userMedia.setModeration(body));
+    });
+    ws.observe('error', body => {
+      console.warn('server error:', body.message);
+    });
     ws.observe('kick', body => {
       delete sessionStorage.inParty;
       if (body.kind && body.kind == 'softBan')
@@ -193,8 +219,29 @@ class Room {
   }
   updateGuest(id, state) {
     const guest = this.getOrCreateGuest(id);
+    const wasHidden = guest.hidden;
     guest.state = state;
+    guest.hidden = false;
     this.observers.fire('update', id, guest);
+    if (wasHidden && (guest.videoTrack || guest.audioTrack))
+      this.observers.fire('updateMedia', id, guest);
+  }
+  applyGuestDelta({ id, changed, removed }) {
+    const guest = this.guests[id];
+    if (!guest || !guest.state || guest.hidden)
+      return;
+    const state = { ...guest.state, ...changed };
+    for (const key of removed || [])
+      delete state[key];
+    this.updateGuest(id, state);
+  }
+  // The guest went out of range but is still around, so hang onto its media.
+  hideGuest(id) {
+    const guest = this.guests[id];
+    if (!guest)
+      return;
+    guest.hidden = true;
+    this.observers.fire('update', id, null);
   }
   removeGuest(id) {
     delete this.guests[id];
@@ -206,7 +253,7 @@ class Room {
   }
   mapTrack({ mid, id }) {
     this.rtcPeer.setMidObserver(mid, track => {
-      const guest = this.guests[id];
+      const guest = this.getOrCreateGuest(id);
       guest[track.kind == 'video' ? 'videoTrack' : 'audioTrack'] = track;
       this.observers.fire('updateMedia', id, guest);
     });
@@ -245,6 +292,13 @@ class Room {
         });
       },
       mediaStream: this.mediaStream,
+      // The server sends each guest whichever of these suits them; "f"
+      // is also what gets recorded.
+      simulcast: [
+        { rid: 'q', scaleResolutionDownBy: 4, maxBitrate: 150000 },
+        { rid: 'h', scaleResolutionDownBy: 2, maxBitrate: 500000 },
+        { rid: 'f' },
+      ],
       onerror() {
         this.ws && this.ws.bounce();
       }
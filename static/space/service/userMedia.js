@@ -13,19 +13,21 @@ const userMedia = {
   audioMuted: sessionStorage.audioMuted == 'true',
   requiredVideoMute: false,
   requiredAudioMute: false,
+  // Set by moderators, who the server won't forward media past anyway.
+  moderation: {},
   stream: new MediaStream(),
   devices: null,
   observers: new Observers(),
   async restart() {
     const newConstraints = {};
-    if (this.audioMuted || this.requiredAudioMute) {
+    if (this.audioMuted || this.requiredAudioMute || this.moderation.audioMuted) {
       this.setTrack(null, 'audio');
       if (this.activeConstraints)
         delete this.activeConstraints.audio;
     } else if (this.pendingConstraints.audio != (this.activeConstraints && this.activeConstraints.audio)) {
       newConstraints.audio = this.pendingConstraints.audio;
     }
-    if (this.videoMuted || this.requiredVideoMute) {
+    if (this.videoMuted || this.requiredVideoMute || this.moderation.videoOff) {
       this.setTrack(null, 'video');
       if (this.activeConstraints)
         delete this.activeConstraints.video;
@@ -82,6 +84,8 @@ export default class UserMediaClient {
       cb(userMedia.videoMuted);
     } else if (key == 'audioMuted') {
       cb(userMedia.audioMuted);
+    } else if (key == 'moderation') {
+      cb(userMedia.moderation);
     } else if (key == 'stream') {
       if (userMedia.stream)
         cb(userMedia.stream);
@@ -106,6 +110,11 @@ export default class UserMediaClient {
     userMedia.requiredAudioMute = on;
     userMedia.restart();
    }
+  setModeration(moderation) {
+    userMedia.moderation = moderation;
+    userMedia.restart();
+    userMedia.observers.fire('moderation', moderation);
+  }
    toggleVideoMuted() {
     sessionStorage.videoMuted = userMedia.videoMuted = !userMedia.videoMuted;
     userMedia.restart();